@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// cloneBundleName is the name of the pre-generated bundle, both in the
+// mirror directory and in the URL it is served at.
+const cloneBundleName = "clone.bundle"
+
+func (repo *repository) bundlePath() string {
+	return filepath.Join(repo.localDir, cloneBundleName)
+}
+
+// bundleable reports whether repo may have a clone bundle. A bundle of
+// a shared store would have the refs of all the namespaces, and a bundle
+// of rewritten refs would have the refs as mirrored, not as advertised.
+func (s *server) bundleable(repo *repository) bool {
+	return repo.namespace == "" && !s.config.repository(repo.path).rewritesRefs()
+}
+
+// scheduleBundle starts building a clone bundle for repo in background
+// if repo is hot and its bundle is older than s.bundleInterval.
+func (s *server) scheduleBundle(repo *repository) {
+	if s.bundleInterval == 0 || atomic.LoadInt64(&repo.clones) < s.bundleHotClones || !s.bundleable(repo) {
+		return
+	}
+
+	builtAt := time.Unix(0, atomic.LoadInt64(&repo.bundleBuiltAt))
+	if time.Now().Before(builtAt.Add(s.bundleInterval)) {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&repo.bundling, 0, 1) {
+		return
+	}
+
+	started := s.goBackground(func() {
+		defer atomic.StoreInt32(&repo.bundling, 0)
+
+		if err := s.buildBundle(repo); err != nil {
+			logger.Printf("[repo %s] Could not build bundle: %s", repo.path, err)
+		}
+	})
+	if !started {
+		atomic.StoreInt32(&repo.bundling, 0)
+	}
+}
+
+// buildBundle creates a bundle of all refs of repo, which clients can
+// download instead of having git-upload-pack make a full pack.
+func (s *server) buildBundle(repo *repository) error {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	tmpPath := repo.bundlePath() + ".tmp"
+	gitBundle := repo.gitCommand("bundle", "create", tmpPath, "--all")
+	if err := gitBundle.run(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, repo.bundlePath()); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&repo.bundleBuiltAt, time.Now().UnixNano())
+	bundleBuilt.Add(1)
+	logger.Printf("[repo %s] Built bundle", repo.path)
+
+	return nil
+}
+
+func (repo *repository) hasBundle() bool {
+	return atomic.LoadInt64(&repo.bundleBuiltAt) != 0
+}
+
+// serveBundle sends the pre-generated bundle of repo, if any.
+// It does not synchronize repo, as clients fetch the rest after
+// unbundling anyway.
+func (s *server) serveBundle(repo *repository, w http.ResponseWriter, req *http.Request) {
+	if !repo.hasBundle() || !s.bundleable(repo) {
+		http.NotFound(w, req)
+		return
+	}
+
+	bundleServed.Add(1)
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	http.ServeFile(w, req, repo.bundlePath())
+}
+
+// bundleURIConfig returns git options making upload-pack advertise the
+// bundle of repo via the protocol v2 "bundle-uri" command.
+// https://github.com/git/git/blob/v2.40.0/Documentation/technical/bundle-uri.txt
+func (s *server) bundleURIConfig(repo *repository, req *http.Request) []string {
+	if !repo.hasBundle() || !s.bundleable(repo) {
+		return nil
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	return []string{
+		"-c", "uploadpack.advertiseBundleURIs=true",
+		"-c", "bundle.version=1",
+		"-c", "bundle.mode=all",
+		"-c", "bundle.clone.uri=" + scheme + "://" + req.Host + "/" + repo.path + ".git/" + cloneBundleName,
+	}
+}
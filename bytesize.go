@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value for sizes in bytes, accepting suffixes like "10G".
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func (b *byteSize) Set(s string) error {
+	n := strings.TrimSuffix(strings.ToUpper(s), "B")
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(n, u.suffix) {
+			n = strings.TrimSuffix(n, u.suffix)
+			unit = u.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size: %q", s)
+	}
+
+	*b = byteSize(v * float64(unit))
+	return nil
+}
+
+func (b byteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if b != 0 && int64(b)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		out byteSize
+		str string
+	}{
+		{"0", 0, "0"},
+		{"1024", 1024, "1K"},
+		{"100", 100, "100"},
+		{"10G", 10 << 30, "10G"},
+		{"1.5k", 1536, "1536"},
+		{"512MB", 512 << 20, "512M"},
+	} {
+		var b byteSize
+		if err := b.Set(test.in); err != nil {
+			t.Errorf("Set(%q): %s", test.in, err)
+			continue
+		}
+		if b != test.out {
+			t.Errorf("Set(%q): got %d != %d", test.in, b, test.out)
+		}
+		if got := b.String(); got != test.str {
+			t.Errorf("String(%d): got %q != %q", b, got, test.str)
+		}
+	}
+
+	for _, in := range []string{"", "G", "-1", "10X"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("Set(%q): expected error", in)
+		}
+	}
+}
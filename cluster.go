@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	peerProxied    = expvar.NewInt("peerProxied")
+	peerRedirected = expvar.NewInt("peerRedirected")
+	peerRefused    = expvar.NewInt("peerRefused")
+)
+
+// forwardedHeader is set on requests proxied between peers
+// so that they are served by the receiver regardless of the ring.
+const forwardedHeader = "X-Mir-Forwarded-By"
+
+// hashRingVirtualNodes is the number of points each peer has on the ring,
+// which evens out the distribution of repositories.
+const hashRingVirtualNodes = 128
+
+// hashRing is a consistent hash ring of peers.
+type hashRing struct {
+	points []uint32
+	peers  map[uint32]string
+}
+
+func hashKey(key string) uint32 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newHashRing(peers []string) hashRing {
+	r := hashRing{peers: map[uint32]string{}}
+	for _, peer := range peers {
+		for i := 0; i < hashRingVirtualNodes; i++ {
+			p := hashKey(peer + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.peers[p] = peer
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owners returns at most n distinct peers responsible for key,
+// in the order of preference.
+func (r hashRing) owners(key string, n int) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	var owners []string
+	seen := map[string]bool{}
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		peer := r.peers[r.points[(start+i)%len(r.points)]]
+		if !seen[peer] {
+			seen[peer] = true
+			owners = append(owners, peer)
+		}
+	}
+	return owners
+}
+
+// cluster routes requests for each repository to the peers owning it,
+// so that a repository is mirrored by only replicas peers in the cluster.
+type cluster struct {
+	self     string
+	replicas int
+	redirect bool
+	ring     hashRing
+	proxies  map[string]*httputil.ReverseProxy
+}
+
+// newCluster creates a cluster of peers, which are base URLs of mir servers
+// and must include self.
+func newCluster(self string, peers []string, replicas int, redirect bool) (*cluster, error) {
+	c := &cluster{
+		self:     strings.TrimSuffix(self, "/"),
+		replicas: replicas,
+		redirect: redirect,
+		proxies:  map[string]*httputil.ReverseProxy{},
+	}
+
+	var hasSelf bool
+	for i, peer := range peers {
+		peer = strings.TrimSuffix(peer, "/")
+		peers[i] = peer
+
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL: %q", peer)
+		}
+
+		if peer == c.self {
+			hasSelf = true
+			continue
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Header.Set(forwardedHeader, c.self)
+		}
+		c.proxies[peer] = proxy
+	}
+
+	if !hasSelf {
+		return nil, fmt.Errorf("peers must include self (%s)", c.self)
+	}
+	if c.replicas < 1 {
+		c.replicas = 1
+	}
+
+	c.ring = newHashRing(peers)
+	return c, nil
+}
+
+// peers returns the peers other than self.
+func (c *cluster) peers() []string {
+	peers := make([]string, 0, len(c.proxies))
+	for peer := range c.proxies {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// peerAddrsFor is the time the resolved addresses of the peers are reused.
+const peerAddrsFor = time.Minute
+
+// isPeerAddr reports whether remoteAddr, like req.RemoteAddr, is an address
+// of one of the peers in cluster or s.fillPeers, resolving their hosts.
+func (s *server) isPeerAddr(remoteAddr string) bool {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	s.peerAddrs.Lock()
+	defer s.peerAddrs.Unlock()
+
+	if s.peerAddrs.addrs == nil || time.Since(s.peerAddrs.resolvedAt) > peerAddrsFor {
+		peers := s.fillPeers
+		if s.cluster != nil {
+			peers = append(s.cluster.peers(), peers...)
+		}
+
+		addrs := map[string]bool{}
+		for _, peer := range peers {
+			u, err := url.Parse(peer)
+			if err != nil {
+				continue
+			}
+			ips, err := net.LookupHost(u.Hostname())
+			if err != nil {
+				logger.Printf("could not resolve peer %s: %s", peer, err)
+				continue
+			}
+			for _, ip := range ips {
+				addrs[net.ParseIP(ip).String()] = true
+			}
+		}
+		s.peerAddrs.addrs = addrs
+		s.peerAddrs.resolvedAt = time.Now()
+	}
+
+	parsed := net.ParseIP(ip)
+	return parsed != nil && s.peerAddrs.addrs[parsed.String()]
+}
+
+// isFromPeer reports whether req is proxied or filling from a peer, that is,
+// has the header set by peers and comes from one of them.
+func (s *server) isFromPeer(req *http.Request) bool {
+	if req.Header.Get(forwardedHeader) == "" && req.Header.Get(fillHeader) == "" {
+		return false
+	}
+	return s.isPeerAddr(req.RemoteAddr)
+}
+
+// owner returns the peer to serve repoPath, which is self if this peer is
+// one of its owners, and reports whether it is.
+func (c *cluster) owner(repoPath string) (string, bool) {
+	owners := c.ring.owners(strings.TrimSuffix(repoPath, ".git"), c.replicas)
+	for _, owner := range owners {
+		if owner == c.self {
+			return owner, true
+		}
+	}
+	return owners[0], false
+}
+
+// route sends the request for repoPath to its owner and reports true,
+// or reports false if the request should be served by this peer.
+// Requests from peers are not to be routed again, which callers check
+// with s.isFromPeer as the headers of peers are trusted only from them.
+func (c *cluster) route(w http.ResponseWriter, req *http.Request, repoPath string) bool {
+	owner, ok := c.owner(repoPath)
+	if ok {
+		return false
+	}
+
+	if c.redirect {
+		peerRedirected.Add(1)
+		http.Redirect(w, req, owner+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	peerProxied.Add(1)
+	logger.Printf("[request %p] Proxying to %s", req, owner)
+	c.proxies[owner].ServeHTTP(w, req)
+	return true
+}
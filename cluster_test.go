@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	peers := []string{"http://mir1:9280", "http://mir2:9280", "http://mir3:9280"}
+	ring := newHashRing(peers)
+
+	counts := map[string]int{}
+	owners := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("org/repo%d", i)
+
+		o := ring.owners(key, 2)
+		if len(o) != 2 || o[0] == o[1] {
+			t.Fatalf("owners(%q, 2) = %v", key, o)
+		}
+
+		counts[o[0]]++
+		owners[key] = o[0]
+	}
+
+	for _, peer := range peers {
+		if counts[peer] < 500 {
+			t.Errorf("peer %s owns only %d of 3000 keys", peer, counts[peer])
+		}
+	}
+
+	// removing a peer only moves the keys it owned
+	ring = newHashRing(peers[:2])
+	for key, owner := range owners {
+		if owner == peers[2] {
+			continue
+		}
+		if o := ring.owners(key, 1); o[0] != owner {
+			t.Errorf("owner of %q moved from %s to %s", key, owner, o[0])
+		}
+	}
+}
+
+func TestServer_RouteNotFromPeer(t *testing.T) {
+	mirBase, err := ioutil.TempDir("", "mir-test-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirBase)
+
+	// peers not on loopback, where the requests come from
+	self, other := "http://192.0.2.1:9280", "http://192.0.2.2:9280"
+	mir := server{basePath: mirBase}
+	mir.cluster, err = newCluster(self, []string{self, other}, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var repoPath string
+	for i := 0; repoPath == ""; i++ {
+		if _, ok := mir.cluster.owner(fmt.Sprintf("foo/repo%d", i)); !ok {
+			repoPath = fmt.Sprintf("foo/repo%d", i)
+		}
+	}
+
+	s := httptest.NewServer(&mir)
+	defer s.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, header := range []string{"", forwardedHeader, fillHeader} {
+		req, err := http.NewRequest("GET", s.URL+"/"+repoPath+".git/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, other)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("request with %q from non-peer not routed: got status %d", header, resp.StatusCode)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"log"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/motemen/go-nuts/logwriter"
@@ -14,11 +17,85 @@ type repoCommand struct {
 	repo   *repository
 	cmd    *exec.Cmd
 	logger *log.Logger
+	// upstream is set if cmd accesses upstream
+	upstream bool
+}
+
+// runningCommands are the commands started and not finished yet.
+var runningCommands = struct {
+	sync.Mutex
+	m map[*exec.Cmd]struct{}
+}{m: map[*exec.Cmd]struct{}{}}
+
+// killRunningCommands kills all the running commands and returns the number of them.
+func killRunningCommands() int {
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+
+	for cmd := range runningCommands.m {
+		cmd.Process.Kill()
+	}
+	return len(runningCommands.m)
+}
+
+// stderrTailSize is the number of bytes kept from the end of the stderr
+// of a command, to be inspected when it fails.
+const stderrTailSize = 4096
+
+// commandError is returned by run when the command fails,
+// along with the last part of its stderr.
+type commandError struct {
+	err      error
+	stderr   []byte
+	upstream bool
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+// tailBuffer keeps the last stderrTailSize bytes written to it.
+type tailBuffer struct {
+	bytes.Buffer
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n, _ := b.Buffer.Write(p)
+	if over := b.Len() - stderrTailSize; over > 0 {
+		b.Next(over)
+	}
+	return n, nil
+}
+
+// commandQueue limits the number of git processes running at once.
+var commandQueue struct {
+	slots   chan struct{}
+	waiting int32
+}
+
+// setMaxCommands sets the maximum number of commands running at once.
+// It must be called before running any commands; zero means no limit.
+func setMaxCommands(n int) {
+	if n > 0 {
+		commandQueue.slots = make(chan struct{}, n)
+	}
+}
+
+// commandQueueSaturated reports whether commands are waiting for others to finish.
+func commandQueueSaturated() bool {
+	return atomic.LoadInt32(&commandQueue.waiting) > 0
 }
 
 func (c repoCommand) run() error {
 	cmd := c.cmd
 
+	if commandQueue.slots != nil {
+		atomic.AddInt32(&commandQueue.waiting, 1)
+		commandQueue.slots <- struct{}{}
+		atomic.AddInt32(&commandQueue.waiting, -1)
+		defer func() { <-commandQueue.slots }()
+	}
+
 	start := time.Now()
 	c.logger.Printf("[command %p] %q starting", cmd, cmd.Args)
 	defer func() {
@@ -27,6 +104,8 @@ func (c repoCommand) run() error {
 		c.logger.Printf("[command %p] %q finished (%s)", cmd, cmd.Args, elapsed)
 	}()
 
+	var stderr *tailBuffer
+
 	for _, s := range []struct {
 		writer *io.Writer
 		name   string
@@ -45,6 +124,10 @@ func (c repoCommand) run() error {
 		}
 
 		*s.writer = w
+		if s.name == "err" {
+			stderr = &tailBuffer{}
+			*s.writer = io.MultiWriter(w, stderr)
+		}
 
 		defer w.Close()
 	}
@@ -54,5 +137,19 @@ func (c repoCommand) run() error {
 		return err
 	}
 
-	return cmd.Wait()
+	runningCommands.Lock()
+	runningCommands.m[cmd] = struct{}{}
+	runningCommands.Unlock()
+
+	defer func() {
+		runningCommands.Lock()
+		delete(runningCommands.m, cmd)
+		runningCommands.Unlock()
+	}()
+
+	err = cmd.Wait()
+	if err != nil && stderr != nil {
+		return &commandError{err: err, stderr: stderr.Bytes(), upstream: c.upstream}
+	}
+	return err
 }
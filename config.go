@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// config is the configuration file given by -config, written in JSON like:
+//
+//	{
+//	  "repositories": [
+//	    { "path": "motemen/*", "pinned": true },
+//	    { "path": "vendor/*", "refsFreshFor": "1h" }
+//	  ]
+//	}
+type config struct {
+	Repositories []repositoryConfig `json:"repositories"`
+}
+
+// repositoryConfig is the configuration for the repositories
+// whose paths match Path, a pattern of path.Match.
+type repositoryConfig struct {
+	Path string `json:"path"`
+	// Pinned repositories are never evicted.
+	Pinned bool `json:"pinned"`
+	// RefsFreshFor overrides -refs-fresh-for.
+	RefsFreshFor *freshness `json:"refsFreshFor"`
+	// MinRefsFreshFor overrides -min-refs-fresh-for.
+	MinRefsFreshFor *freshness `json:"minRefsFreshFor"`
+	// IncludeRefs and ExcludeRefs limit the refs mirrored and served,
+	// each a full ref name or a prefix ending with "/*".
+	IncludeRefs []string `json:"includeRefs"`
+	ExcludeRefs []string `json:"excludeRefs"`
+	// ForkOf is the path of the repository the repositories are forks of,
+	// whose mirror they borrow objects from.
+	ForkOf string `json:"forkOf"`
+	// Store is the name of the shared store the repositories are mirrored
+	// into as git namespaces, instead of their own mirrors.
+	Store string `json:"store"`
+	// RewriteRefs maps prefixes of ref names to those advertised to clients
+	// instead. Only the refs matching them are advertised.
+	RewriteRefs map[string]string `json:"rewriteRefs"`
+}
+
+func loadConfig(file string) (*config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+
+	for i, rc := range c.Repositories {
+		// compared with repository paths, which have no suffix
+		c.Repositories[i].ForkOf = strings.TrimSuffix(rc.ForkOf, ".git")
+
+		if _, err := path.Match(rc.Path, ""); err != nil {
+			return nil, err
+		}
+		for _, p := range append(rc.IncludeRefs, rc.ExcludeRefs...) {
+			if err := validateRefPattern(p); err != nil {
+				return nil, err
+			}
+		}
+		for from, to := range rc.RewriteRefs {
+			if !strings.HasPrefix(from, "refs/") || !strings.HasSuffix(from, "/") || !strings.HasPrefix(to, "refs/") || !strings.HasSuffix(to, "/") {
+				return nil, fmt.Errorf("ref prefixes to rewrite must be like refs/.../: %q: %q", from, to)
+			}
+		}
+	}
+
+	return &c, nil
+}
+
+// isForkBase reports whether repoPath is the base of any forks.
+// c may be nil.
+func (c *config) isForkBase(repoPath string) bool {
+	if c == nil {
+		return false
+	}
+
+	for _, rc := range c.Repositories {
+		if rc.ForkOf == repoPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// repository returns the configuration of the first entry that matches repoPath.
+// c may be nil, in that case the zero configuration is returned.
+func (c *config) repository(repoPath string) repositoryConfig {
+	if c == nil {
+		return repositoryConfig{}
+	}
+
+	for _, rc := range c.Repositories {
+		if ok, _ := path.Match(rc.Path, repoPath); ok {
+			return rc
+		}
+	}
+
+	return repositoryConfig{}
+}
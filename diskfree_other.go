@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeDiskSpace is not supported on this platform.
+func freeDiskSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("free disk space not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dumbHTTPPath matches the paths of files that Git dumb HTTP clients request.
+// https://github.com/git/git/blob/v2.39.0/Documentation/technical/http-protocol.txt
+var dumbHTTPPath = regexp.MustCompile(`^/(.+?)/(HEAD|info/refs|objects/info/(?:packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(?:pack|idx))$`)
+
+// dumbContentType returns the content type git-http-backend uses for file.
+func dumbContentType(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".pack"):
+		return "application/x-git-packed-objects"
+	case strings.HasSuffix(file, ".idx"):
+		return "application/x-git-packed-objects-toc"
+	case strings.HasPrefix(file, "objects/info/"):
+		return "text/plain; charset=utf-8"
+	case strings.HasPrefix(file, "objects/"):
+		return "application/x-git-loose-object"
+	default:
+		return "text/plain"
+	}
+}
+
+// serveDumb sends file of repo to a dumb HTTP client. Refs are synchronized
+// on ref discovery, that is, requests for info/refs and HEAD.
+func (s *server) serveDumb(repo *repository, w http.ResponseWriter, req *http.Request, file string) {
+	// the files of a shared store have the refs of all the namespaces,
+	// the refs and objects served as files cannot be filtered nor rewritten,
+	// and forks lack the objects borrowed from the base
+	if rc := s.config.repository(repo.path); repo.namespace != "" || rc.filtersRefs() || rc.rewritesRefs() || rc.ForkOf != "" {
+		http.NotFound(w, req)
+		return
+	}
+	// alternates have local paths, which clients cannot follow and must not see
+	if file == "objects/info/alternates" || file == "objects/info/http-alternates" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if file == "info/refs" || file == "HEAD" {
+		if !s.synchronizeOrStale(repo, w, req) {
+			return
+		}
+	}
+	if file == "info/refs" || file == "objects/info/packs" {
+		s.ensureServerInfo(repo)
+	}
+
+	repo.RLock()
+	defer repo.RUnlock()
+
+	f, err := os.Open(filepath.Join(repo.localDir, filepath.FromSlash(file)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, req)
+		} else {
+			logger.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dumbContentType(file))
+	if strings.HasPrefix(file, "objects/") && !strings.HasPrefix(file, "objects/info/") {
+		// objects never change once written
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(w, req, "", fi.ModTime(), f)
+}
+
+// ensureServerInfo updates the auxiliary files for dumb HTTP clients if they
+// are missing, as for mirrors created before serving dumb HTTP, imported,
+// or not changed since.
+func (s *server) ensureServerInfo(repo *repository) {
+	infoRefs := filepath.Join(repo.localDir, "info", "refs")
+	if _, err := os.Stat(infoRefs); !os.IsNotExist(err) {
+		return
+	}
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	if _, err := os.Stat(infoRefs); os.IsNotExist(err) && repo.exists() {
+		s.updateServerInfo(repo)
+	}
+}
+
+// updateServerInfo updates the auxiliary files for dumb HTTP clients,
+// if s serves them. Caller must hold the write lock of repo.
+func (s *server) updateServerInfo(repo *repository) {
+	if !s.dumbHTTP {
+		return
+	}
+
+	if err := repo.gitCommand("update-server-info").run(); err != nil {
+		logger.Printf("[repo %s] Could not update server info: %s", repo.path, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mirrorEvicted      = expvar.NewInt("mirrorEvicted")
+	mirrorEvictedBytes = expvar.NewInt("mirrorEvictedBytes")
+)
+
+// touch records that repo is accessed now.
+func (repo *repository) touch() {
+	atomic.StoreInt64(&repo.lastAccessed, time.Now().UnixNano())
+}
+
+func (repo *repository) lastAccessedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&repo.lastAccessed))
+}
+
+// discoverRepositories registers the mirrors already under s.basePath,
+// left by previous runs, so that they are subject to eviction and pre-warming.
+// Their last access times are taken from the modification times of the directories.
+func (s *server) discoverRepositories() error {
+	return filepath.Walk(s.basePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if fi.Name() == quarantineDirName || fi.Name() == storesDirName || strings.Contains(fi.Name(), tempDirInfix) {
+			return filepath.SkipDir
+		}
+		if !isGitDir(path) {
+			return nil
+		}
+
+		repoPath, err := filepath.Rel(s.basePath, path)
+		if err != nil {
+			return err
+		}
+
+		repo, err := s.repository(filepath.ToSlash(repoPath))
+		if err != nil {
+			logger.Printf("Not discovering %s: %s", path, err)
+			return filepath.SkipDir
+		}
+		atomic.StoreInt64(&repo.lastAccessed, fi.ModTime().UnixNano())
+		return filepath.SkipDir
+	})
+}
+
+// evictionLoop periodically removes the mirrors idle for s.evictIdleAfter
+// and, while the total size of mirrors exceeds s.maxDiskUsage, the least
+// recently used ones, as well as the mirrors quarantined for longer than
+// s.quarantineRetention.
+func (s *server) evictionLoop() {
+	tick := time.Minute
+	if s.evictIdleAfter > 0 && s.evictIdleAfter/10 < tick {
+		tick = s.evictIdleAfter / 10
+	}
+	if tick < time.Second {
+		tick = time.Second
+	}
+
+	for range time.Tick(tick) {
+		if s.quarantineRetention > 0 {
+			s.removeExpiredQuarantines()
+		}
+		if s.maxDiskUsage > 0 || s.evictIdleAfter > 0 {
+			s.evictRepositories()
+		}
+	}
+}
+
+// evictionCandidate is a mirror which may be evicted, as of lastAccessed.
+type evictionCandidate struct {
+	repo         *repository
+	size         int64
+	lastAccessed time.Time
+}
+
+func (s *server) evictRepositories() {
+	var (
+		candidates []evictionCandidate
+		totalSize  int64
+	)
+	for _, repo := range s.repositories() {
+		// shared stores are never evicted
+		if !repo.exists() || repo.namespace != "" {
+			continue
+		}
+
+		size, err := dirSize(repo.localDir)
+		if err != nil {
+			logger.Printf("[repo %s] Could not compute size: %s", repo.path, err)
+			continue
+		}
+
+		totalSize += size
+		// forks borrow objects from their bases
+		if s.config.repository(repo.path).Pinned || s.config.isForkBase(repo.path) {
+			continue
+		}
+		candidates = append(candidates, evictionCandidate{repo, size, repo.lastAccessedAt()})
+	}
+
+	// quarantined mirrors take the disk as well, and are removed first
+	if s.maxDiskUsage > 0 {
+		totalSize = s.evictQuarantines(totalSize)
+	}
+
+	s.evictCandidates(candidates, totalSize)
+}
+
+// evictCandidates evicts the mirrors of candidates least recently accessed
+// first, which are idle or while all the mirrors of totalSize are over quota,
+// and returns the total size left.
+func (s *server) evictCandidates(candidates []evictionCandidate, totalSize int64) int64 {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccessed.Before(candidates[j].lastAccessed)
+	})
+
+	for _, c := range candidates {
+		idle := s.evictIdleAfter > 0 && time.Since(c.lastAccessed) > s.evictIdleAfter
+		overQuota := s.maxDiskUsage > 0 && totalSize > int64(s.maxDiskUsage)
+		if !idle && !overQuota {
+			continue
+		}
+
+		evicted, err := s.evict(c.repo, c.lastAccessed)
+		if err != nil {
+			logger.Printf("[repo %s] Could not evict: %s", c.repo.path, err)
+		}
+		if !evicted {
+			continue
+		}
+
+		totalSize -= c.size
+		mirrorEvicted.Add(1)
+		mirrorEvictedBytes.Add(c.size)
+		logger.Printf("[repo %s] Evicted mirror (%d bytes, last accessed at %s, idle=%v, overQuota=%v)", c.repo.path, c.size, c.lastAccessed, idle, overQuota)
+	}
+
+	return totalSize
+}
+
+// evictQuarantines removes the oldest quarantined mirrors while they and the
+// mirrors of mirrorsSize in total exceed s.maxDiskUsage, and returns the total.
+func (s *server) evictQuarantines(mirrorsSize int64) int64 {
+	qs, err := s.quarantines()
+	if err != nil {
+		logger.Printf("Could not list quarantined mirrors: %s", err)
+		return mirrorsSize
+	}
+
+	totalSize := mirrorsSize
+	sizes := make([]int64, len(qs))
+	for i, q := range qs {
+		size, err := dirSize(q.dir)
+		if err != nil {
+			logger.Printf("Could not compute size of %s: %s", q.dir, err)
+			continue
+		}
+		sizes[i] = size
+		totalSize += size
+	}
+
+	for i, q := range qs {
+		if totalSize <= int64(s.maxDiskUsage) {
+			break
+		}
+		if err := removeQuarantine(q, "over quota"); err != nil {
+			logger.Printf("Could not remove quarantined mirrors: %s", err)
+			continue
+		}
+		totalSize -= sizes[i]
+	}
+
+	return totalSize
+}
+
+// evict removes the mirror of repo under its write lock, and reports whether
+// it did, which it does not if repo is accessed after lastAccessed.
+func (s *server) evict(repo *repository, lastAccessed time.Time) (bool, error) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if repo.lastAccessedAt().After(lastAccessed) {
+		return false, nil
+	}
+
+	if !isUnder(s.basePath, repo.localDir) {
+		return false, fmt.Errorf("%s is not under base path, not removing", repo.localDir)
+	}
+
+	// rename first so that a partially removed mirror is never used
+	tmpDir := repo.localDir + tempDirInfix + "evicted"
+	if err := os.Rename(repo.localDir, tmpDir); err != nil {
+		return false, err
+	}
+
+	repo.lastSynchronized = time.Time{}
+	atomic.StoreInt64(&repo.bundleBuiltAt, 0)
+	s.refsChanged(repo)
+
+	return true, os.RemoveAll(tmpDir)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"os"
+)
+
+var (
+	peerFilled     = expvar.NewInt("peerFilled")
+	peerFillFailed = expvar.NewInt("peerFillFailed")
+)
+
+// fillHeader is set on requests from peers filling their new mirrors.
+// Such requests are served only from existing mirrors, without
+// synchronizing nor routing in cluster.
+const fillHeader = "X-Mir-Fill"
+
+// isFillRequest reports whether req is from a peer filling its new mirror.
+// The header is trusted only from the peers.
+func (s *server) isFillRequest(req *http.Request) bool {
+	return req.Header.Get(fillHeader) != "" && s.isPeerAddr(req.RemoteAddr)
+}
+
+// fillFromPeers clones repo into the empty directory dir from one of
+// s.fillPeers which has it already, and then updates it from upstream.
+// The objects in the repository at reference, if any, are borrowed.
+// It reports whether dir is filled; otherwise dir is left empty.
+func (s *server) fillFromPeers(repo *repository, dir, reference string) bool {
+	for _, peer := range s.fillPeers {
+		args := append([]string{"-c", "http.extraHeader=" + fillHeader + ": 1", "clone", "--verbose", "--mirror"}, referenceArgs(reference)...)
+		gitClone := repo.gitCommand(append(args, peer+"/"+repo.path+".git", ".")...)
+		gitClone.cmd.Dir = dir
+		if err := gitClone.run(); err != nil {
+			peerFillFailed.Add(1)
+			logger.Printf("[repo %s] Could not fill from peer %s: %s", repo.path, peer, err)
+			resetDir(dir)
+			continue
+		}
+
+		gitRemote := repo.gitCommand("--git-dir=.", "remote", "set-url", "origin", repo.upstreamURL)
+		gitRemote.cmd.Dir = dir
+		if err := gitRemote.run(); err != nil {
+			logger.Printf("[repo %s] Could not set upstream: %s", repo.path, err)
+			resetDir(dir)
+			return false
+		}
+
+		if rc := s.config.repository(repo.path); rc.filtersRefs() {
+			if err := repo.setFetchRefspecs(dir, rc); err != nil {
+				logger.Printf("[repo %s] Could not set refspecs: %s", repo.path, err)
+				resetDir(dir)
+				return false
+			}
+		}
+
+		peerFilled.Add(1)
+		logger.Printf("[repo %s] Filled from peer %s", repo.path, peer)
+
+		// a failure here is not fatal, as the mirror is just as stale as the peer's
+		gitRemoteUpdate := repo.gitCommand("--git-dir=.", "remote", "--verbose", "update")
+		gitRemoteUpdate.cmd.Dir = dir
+		if err := gitRemoteUpdate.run(); err != nil {
+			logger.Printf("[repo %s] Could not update from upstream after filling: %s", repo.path, err)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// resetDir empties dir.
+func resetDir(dir string) {
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+// forkReference returns the absolute path of the mirror of the repository
+// repo is a fork of, synchronizing it if absent, so that repo borrows
+// objects from it. It returns an empty string if repo is not a fork or
+// the mirror is not available.
+func (s *server) forkReference(repo *repository) string {
+	rc := s.config.repository(repo.path)
+	if rc.ForkOf == "" || rc.ForkOf == repo.path {
+		return ""
+	}
+
+	base, err := s.repository(rc.ForkOf)
+	if err != nil {
+		logger.Printf("[repo %s] Invalid base: %s", repo.path, err)
+		return ""
+	}
+	// chains of forks could deadlock synchronizing each other;
+	// the base may match the same pattern as repo, forking itself
+	if bc := s.config.repository(base.path); bc.ForkOf != "" && bc.ForkOf != base.path {
+		logger.Printf("[repo %s] Base %s is a fork too, not borrowing objects", repo.path, base.path)
+		return ""
+	}
+
+	if !base.exists() {
+		if err := s.synchronizeCache(base); err != nil {
+			logger.Printf("[repo %s] Could not synchronize base %s: %s", repo.path, base.path, err)
+			return ""
+		}
+	}
+
+	// unreachable objects in the base may be reachable from forks
+	base.Lock()
+	err = base.gitCommand("config", "gc.pruneExpire", "never").run()
+	base.Unlock()
+	if err != nil {
+		logger.Printf("[repo %s] Could not keep base %s from pruning: %s", repo.path, base.path, err)
+		return ""
+	}
+
+	dir, err := filepath.Abs(base.localDir)
+	if err != nil {
+		logger.Println(err)
+		return ""
+	}
+	return dir
+}
+
+// referenceArgs returns the options for "git clone" to borrow objects
+// from the repository at reference, if any.
+func referenceArgs(reference string) []string {
+	if reference == "" {
+		return nil
+	}
+	return []string{"--reference", reference}
+}
+
+// writeAlternates makes the repository in dir borrow objects from the
+// repository at reference, as "git clone --reference" does.
+func writeAlternates(dir, reference string) error {
+	return ioutil.WriteFile(filepath.Join(dir, "objects", "info", "alternates"), []byte(filepath.Join(reference, "objects")+"\n"), 0666)
+}
+
+// maintenanceCommandsFor returns the maintenance commands of repo.
+// Forks do not pack the objects borrowed from their base, and so cannot
+// have bitmaps, while bases keep unreachable objects which forks may need.
+func (s *server) maintenanceCommandsFor(repo *repository) [][]string {
+	repack := maintenanceCommands[0]
+	switch {
+	case repo.namespace == "" && s.config.repository(repo.path).ForkOf != "":
+		repack = []string{"repack", "-a", "-d", "-l"}
+	case s.config.isForkBase(repo.path):
+		repack = append(repack[:len(repack):len(repack)], "--keep-unreachable")
+	}
+
+	return append([][]string{repack}, maintenanceCommands[1:]...)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var freshnessRequested = expvar.NewInt("freshnessRequested")
+
+// pinnedFreshness is the freshness of refs of pinned repositories,
+// whose existing mirrors are never synchronized automatically.
+const pinnedFreshness = time.Duration(math.MaxInt64)
+
+// freshnessHeader is set by clients to request refs fresher than configured,
+// in a duration like "30s" or seconds. The query parameter "fresh" does the same.
+const freshnessHeader = "X-Mir-Refs-Fresh-For"
+
+// freshness is the duration to consider synchronized refs fresh,
+// written in the configuration file as a duration like "10m" or "pinned".
+type freshness time.Duration
+
+func (f *freshness) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	if s == "pinned" {
+		*f = freshness(pinnedFreshness)
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid freshness: %q", s)
+	}
+	*f = freshness(d)
+	return nil
+}
+
+// parseFreshness parses a freshness requested by a client.
+func parseFreshness(s string) (time.Duration, bool) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, true
+	}
+	return 0, false
+}
+
+// minFreshnessFor returns the minimum duration to consider the refs of
+// repoPath fresh, configured by -min-refs-fresh-for and the configuration file.
+func (s *server) minFreshnessFor(repoPath string) time.Duration {
+	if rc := s.config.repository(repoPath); rc.MinRefsFreshFor != nil {
+		return time.Duration(*rc.MinRefsFreshFor)
+	}
+	return s.minRefsFreshFor
+}
+
+// freshnessFor returns the duration to consider the refs of repoPath fresh
+// when serving req, which may be nil. It is configured by -refs-fresh-for
+// and the configuration file, and clients may request fresher refs down to
+// the minimum configured by -min-refs-fresh-for and the configuration file,
+// but never for pinned repositories.
+func (s *server) freshnessFor(repoPath string, req *http.Request) time.Duration {
+	rc := s.config.repository(repoPath)
+
+	freshFor := s.refsFreshFor
+	if rc.RefsFreshFor != nil {
+		freshFor = time.Duration(*rc.RefsFreshFor)
+	}
+
+	if req == nil || freshFor == pinnedFreshness {
+		return freshFor
+	}
+
+	v := req.URL.Query().Get("fresh")
+	if v == "" {
+		v = req.Header.Get(freshnessHeader)
+	}
+	if v == "" {
+		return freshFor
+	}
+
+	requested, ok := parseFreshness(v)
+	if !ok {
+		return freshFor
+	}
+
+	if min := s.minFreshnessFor(repoPath); requested < min {
+		requested = min
+	}
+
+	if requested < freshFor {
+		freshnessRequested.Add(1)
+		return requested
+	}
+	return freshFor
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshness_UnmarshalJSON(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(`{"repositories":[{"path":"a/*","refsFreshFor":"10m"},{"path":"b/*","refsFreshFor":"pinned"}]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(*c.Repositories[0].RefsFreshFor); got != 10*time.Minute {
+		t.Errorf("got %s", got)
+	}
+	if got := time.Duration(*c.Repositories[1].RefsFreshFor); got != pinnedFreshness {
+		t.Errorf("got %s", got)
+	}
+
+	for _, in := range []string{`"forever"`, `"-1s"`, `10`} {
+		var f freshness
+		if err := json.Unmarshal([]byte(in), &f); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+func TestServer_FreshnessFor(t *testing.T) {
+	tenMinutes, pinned, oneMinute := freshness(10*time.Minute), freshness(pinnedFreshness), freshness(time.Minute)
+	s := &server{
+		refsFreshFor:    5 * time.Second,
+		minRefsFreshFor: time.Second,
+		config: &config{
+			Repositories: []repositoryConfig{
+				{Path: "vendor/*", RefsFreshFor: &tenMinutes, MinRefsFreshFor: &oneMinute},
+				{Path: "frozen/*", RefsFreshFor: &pinned, MinRefsFreshFor: &pinned},
+				{Path: "archive/*", RefsFreshFor: &pinned},
+			},
+		},
+	}
+
+	request := func(url string, header string) *http.Request {
+		req, _ := http.NewRequest("GET", url, nil)
+		if header != "" {
+			req.Header.Set(freshnessHeader, header)
+		}
+		return req
+	}
+
+	for _, test := range []struct {
+		repoPath string
+		req      *http.Request
+		expected time.Duration
+	}{
+		{"foo/bar", nil, 5 * time.Second},
+		{"foo/bar", request("http://mir/foo/bar.git/info/refs?fresh=0", ""), time.Second},
+		{"foo/bar", request("http://mir/foo/bar.git/info/refs", "3"), 3 * time.Second},
+		{"foo/bar", request("http://mir/foo/bar.git/info/refs", "1h"), 5 * time.Second},
+		{"foo/bar", request("http://mir/foo/bar.git/info/refs", "invalid"), 5 * time.Second},
+		{"vendor/lib", nil, 10 * time.Minute},
+		{"vendor/lib", request("http://mir/vendor/lib.git/info/refs?fresh=0", ""), time.Minute},
+		{"frozen/lib", nil, pinnedFreshness},
+		{"frozen/lib", request("http://mir/frozen/lib.git/info/refs?fresh=0", ""), pinnedFreshness},
+		{"archive/lib", request("http://mir/archive/lib.git/info/refs", "0"), pinnedFreshness},
+	} {
+		if got := s.freshnessFor(test.repoPath, test.req); got != test.expected {
+			t.Errorf("freshnessFor(%q, %v) = %s, expected %s", test.repoPath, test.req, got, test.expected)
+		}
+	}
+}
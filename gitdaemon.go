@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var gitDaemonRequests = expvar.NewInt("gitDaemonRequests")
+
+// gitDaemonRequestTimeout is the time a git:// client has to send its request.
+const gitDaemonRequestTimeout = 30 * time.Second
+
+// serveGitDaemon serves the native Git protocol (git://) on l,
+// from the same mirrors as HTTP.
+// https://github.com/git/git/blob/v2.39.0/Documentation/technical/pack-protocol.txt
+func (s *server) serveGitDaemon(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Println(err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.goBackground(func() { s.handleGitDaemonConn(conn) }) {
+			conn.Close()
+		}
+	}
+}
+
+// gitDaemonRequest is the first pkt-line a git:// client sends, like
+// "git-upload-pack /path\0host=example.com\0\0version=2\0".
+type gitDaemonRequest struct {
+	service     string
+	path        string
+	host        string
+	extraParams []string
+}
+
+func parseGitDaemonRequest(line []byte) (req gitDaemonRequest, err error) {
+	parts := strings.Split(string(line), "\000")
+
+	command := strings.SplitN(strings.TrimSuffix(parts[0], "\n"), " ", 2)
+	if len(command) != 2 {
+		return req, fmt.Errorf("invalid request: %q", line)
+	}
+	req.service, req.path = command[0], command[1]
+
+	for _, param := range parts[1:] {
+		if strings.HasPrefix(param, "host=") && req.host == "" {
+			req.host = strings.TrimPrefix(param, "host=")
+		} else if param != "" {
+			req.extraParams = append(req.extraParams, param)
+		}
+	}
+
+	return req, nil
+}
+
+// readPktLine reads exactly one pkt-line from r.
+func readPktLine(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	var n int
+	if _, err := fmt.Sscanf(string(buf), "%04x", &n); err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length: %q", buf)
+	}
+	if n > 4 {
+		buf = append(buf, make([]byte, n-4)...)
+		if _, err := io.ReadFull(r, buf[4:]); err != nil {
+			return nil, err
+		}
+	}
+
+	_, token, err := splitPktLine(buf, true)
+	return token, err
+}
+
+func writeErrPktLine(w io.Writer, msg string) {
+	line := "ERR " + msg + "\n"
+	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+}
+
+func (s *server) handleGitDaemonConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(gitDaemonRequestTimeout))
+	line, err := readPktLine(conn)
+	if err != nil {
+		logger.Printf("[git %s] %s", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	req, err := parseGitDaemonRequest(bytes.TrimSuffix(line, []byte{0}))
+	if err != nil {
+		logger.Printf("[git %s] %s", conn.RemoteAddr(), err)
+		writeErrPktLine(conn, err.Error())
+		return
+	}
+
+	gitDaemonRequests.Add(1)
+	logger.Printf("[git %s] %s %s %v", conn.RemoteAddr(), req.service, req.path, req.extraParams)
+
+	if req.service != "git-upload-pack" {
+		writeErrPktLine(conn, "service not enabled: "+req.service)
+		return
+	}
+
+	if err := s.serveNativeUploadPack(conn, req.path, strings.Join(req.extraParams, ":"), conn.RemoteAddr().String(), ""); err != nil {
+		logger.Printf("[git %s] %s", conn.RemoteAddr(), err)
+	}
+}
+
+// serveNativeUploadPack serves git-upload-pack of the repository at path on rw
+// to a git:// or SSH client at remoteAddr, authenticated as identity if any.
+// protocol is the Git protocol the client requested, like "version=2".
+// Errors are sent to the client as well.
+func (s *server) serveNativeUploadPack(rw io.ReadWriter, path, protocol, remoteAddr, identity string) error {
+	fail := func(msg string) error {
+		writeErrPktLine(rw, msg)
+		return errors.New(msg)
+	}
+
+	repoPath := strings.TrimSuffix(strings.TrimPrefix(path, "/"), ".git")
+	if err := validateRepositoryPath(repoPath); err != nil {
+		return fail(err.Error())
+	}
+	// git:// and SSH cannot be proxied to peers, which serve HTTP
+	if s.cluster != nil {
+		if owner, ok := s.cluster.owner(repoPath); !ok {
+			peerRefused.Add(1)
+			return fail("repository is served by " + owner)
+		}
+	}
+
+	if s.throttleNative(rw, remoteAddr, identity, repoPath) {
+		return errors.New("rate limited")
+	}
+	// the refs advertised by git upload-pack are not rewritten
+	if s.config.repository(repoPath).rewritesRefs() {
+		return fail("repository not served over git:// nor SSH: " + path)
+	}
+
+	repo, err := s.repository(repoPath)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if s.offline && !repo.exists() {
+		return fail("repository not found: " + path)
+	}
+	repo.touch()
+
+	if _, err := s.synchronizeForServing(repo, nil); err != nil {
+		return fail(err.Error())
+	}
+
+	repo.RLock()
+	defer repo.RUnlock()
+
+	gitArgs := append(s.config.repository(repo.path).hideRefsConfig(), "upload-pack", "--strict", ".")
+	gitUploadPack := repo.gitCommand(gitArgs...)
+	gitUploadPack.cmd.Stdin = rw
+	gitUploadPack.cmd.Stdout = rw
+	gitUploadPack.cmd.Env = repo.uploadPackEnv(protocol)
+	return gitUploadPack.run()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// goBackground runs f in a goroutine which draining waits for.
+// It reports false without running f if s is draining.
+func (s *server) goBackground(f func()) bool {
+	s.drainMu.Lock()
+	if s.isDraining() {
+		s.drainMu.Unlock()
+		return false
+	}
+	s.background.Add(1)
+	s.drainMu.Unlock()
+
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+	return true
+}
+
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// drain stops srv and listeners of git:// and SSH from accepting connections
+// and waits for in-flight requests and background tasks, like synchronizations
+// and maintenance, to finish in timeout. If they do not, running git commands
+// are killed; mirrors are left intact as clones are done in temporary directories.
+func (s *server) drain(srv *http.Server, listeners []net.Listener, timeout time.Duration) error {
+	s.drainMu.Lock()
+	atomic.StoreInt32(&s.draining, 1)
+	s.drainMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, l := range listeners {
+		if l != nil {
+			l.Close()
+		}
+	}
+
+	err := srv.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		n := killRunningCommands()
+		return fmt.Errorf("could not drain in %s, killed %d commands: %s", timeout, n, err)
+	}
+
+	return nil
+}
+
+// systemdListeners returns the listeners passed by systemd socket activation
+// or another process handing off its listeners, in the order of LISTEN_FDS.
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", err)
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	// file descriptors start at 3 (SD_LISTEN_FDS_START)
+	var listeners []net.Listener
+	for fd := 3; fd < 3+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
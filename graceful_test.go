@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_Drain(t *testing.T) {
+	var s server
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: &s}
+	go srv.Serve(l)
+
+	// a background task finishing in time
+	finished := false
+	s.goBackground(func() {
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	})
+
+	if err := s.drain(srv, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Fatal("drain did not wait for background task")
+	}
+	if s.goBackground(func() {}) {
+		t.Fatal("background task started while draining")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("still accepting connections after drain")
+	}
+}
+
+func TestServer_DrainTimeout(t *testing.T) {
+	var s server
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: &s}
+	go srv.Serve(l)
+
+	// a command not finishing in time
+	done := make(chan error)
+	s.goBackground(func() {
+		done <- repoCommand{cmd: exec.Command("sleep", "60"), logger: logger}.run()
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s.drain(srv, nil, 100*time.Millisecond); err == nil {
+		t.Fatal("expected drain to time out")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected command to be killed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not killed")
+	}
+}
+
+func TestServer_DrainConcurrently(t *testing.T) {
+	var s server
+
+	srv := &http.Server{Handler: &s}
+
+	var drained, late int32
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.goBackground(func() {
+					if atomic.LoadInt32(&drained) != 0 {
+						atomic.AddInt32(&late, 1)
+					}
+				})
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := s.drain(srv, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&drained, 1)
+
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&late); n > 0 {
+		t.Fatalf("%d background tasks ran after drain", n)
+	}
+}
+
+func TestServer_DrainWarmUp(t *testing.T) {
+	if _, err := gitDaemon.addRepo("foo/prewarm"); err != nil {
+		t.Fatal(err)
+	}
+
+	mir := newTestMir(t, func(mir *server) {
+		mir.prewarm = true
+	})
+	if err := mir.synchronizeCache(mirRepository(t, mir, "foo/prewarm")); err != nil {
+		t.Fatal(err)
+	}
+	mir.repos.m = nil
+
+	mir.startWarmUp()
+	if err := mir.drain(&http.Server{}, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&mir.warming) != 0 {
+		t.Fatal("drain did not wait for warming up")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// canaryTimeout is the time the deep readiness check waits for upstream.
+	canaryTimeout = 10 * time.Second
+	// canaryCacheFor is the time the result of the deep readiness check is reused.
+	canaryCacheFor = 10 * time.Second
+)
+
+// startWarmUp discovers the mirrors left by previous runs and, with s.prewarm,
+// synchronizes them in background, while s reports not ready.
+func (s *server) startWarmUp() {
+	atomic.StoreInt32(&s.warming, 1)
+	// draining waits for the synchronization in progress, if any
+	started := s.goBackground(func() {
+		defer atomic.StoreInt32(&s.warming, 0)
+		s.warmUp()
+	})
+	if !started {
+		atomic.StoreInt32(&s.warming, 0)
+	}
+}
+
+func (s *server) warmUp() {
+	if err := s.discoverRepositories(); err != nil {
+		logger.Printf("could not discover repositories: %s", err)
+	}
+
+	if !s.prewarm {
+		return
+	}
+
+	for _, repo := range s.repositories() {
+		if s.isDraining() {
+			return
+		}
+		if err := s.synchronizeCache(repo); err != nil {
+			logger.Printf("[repo %s] Could not pre-warm: %s", repo.path, err)
+		}
+	}
+}
+
+// healthProblems returns what prevents s from working at all.
+func (s *server) healthProblems() []string {
+	var problems []string
+
+	if _, err := exec.LookPath("git"); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	f, err := ioutil.TempFile(s.basePath, ".mir-healthz-")
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("base path not writable: %s", err))
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	return problems
+}
+
+// readinessProblems returns what prevents s from taking more requests.
+// With deep, upstream is checked by listing refs of s.canaryRepo.
+func (s *server) readinessProblems(deep bool) []string {
+	var problems []string
+
+	if atomic.LoadInt32(&s.warming) != 0 {
+		problems = append(problems, "warming up")
+	}
+	if s.isDraining() {
+		problems = append(problems, "draining")
+	}
+
+	if s.minFreeDisk > 0 {
+		if free, err := freeDiskSpace(s.basePath); err != nil {
+			problems = append(problems, fmt.Sprintf("could not stat base path: %s", err))
+		} else if free < int64(s.minFreeDisk) {
+			problems = append(problems, fmt.Sprintf("disk nearly full: %s free", byteSize(free)))
+		}
+	}
+
+	if commandQueueSaturated() {
+		problems = append(problems, "git process queue saturated")
+	}
+
+	if deep && s.canaryRepo != "" && !s.offline {
+		if problem := s.canaryProblem(); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// canaryProblem lists refs of s.canaryRepo in upstream and returns the error
+// if any. The result is reused for canaryCacheFor, so that requests to
+// /readyz?deep=1, which need no authentication, do not each reach upstream.
+func (s *server) canaryProblem() string {
+	s.canary.Lock()
+	defer s.canary.Unlock()
+
+	if !s.canary.checkedAt.IsZero() && time.Since(s.canary.checkedAt) < canaryCacheFor {
+		return s.canary.problem
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), canaryTimeout)
+	defer cancel()
+
+	s.canary.problem = ""
+	if out, err := exec.CommandContext(ctx, "git", "ls-remote", s.upstream+s.canaryRepo, "HEAD").CombinedOutput(); err != nil {
+		s.canary.problem = fmt.Sprintf("upstream canary %s: %s: %s", s.canaryRepo, err, strings.TrimSpace(string(out)))
+	}
+	s.canary.checkedAt = time.Now()
+
+	return s.canary.problem
+}
+
+func respondProblems(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *server) serveHealthz(w http.ResponseWriter, req *http.Request) {
+	respondProblems(w, s.healthProblems())
+}
+
+// serveReadyz reports readiness; "?deep=1" also checks upstream.
+func (s *server) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	problems := s.healthProblems()
+	problems = append(problems, s.readinessProblems(req.URL.Query().Get("deep") != "")...)
+	respondProblems(w, problems)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServer_Health(t *testing.T) {
+	mirBase, err := ioutil.TempDir("", "mir-test-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirBase)
+
+	mir := server{
+		basePath:   mirBase,
+		upstream:   fmt.Sprintf("git://localhost:%d/", gitDaemon.port),
+		canaryRepo: "health/canary",
+	}
+
+	s := httptest.NewServer(&mir)
+	defer s.Close()
+
+	expectStatus := func(path string, status int) {
+		t.Helper()
+
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("GET %s: got status %d (%q), expected %d", path, resp.StatusCode, body, status)
+		}
+	}
+
+	expectStatus("/healthz", http.StatusOK)
+	expectStatus("/readyz", http.StatusOK)
+	expectStatus("/readyz?deep=1", http.StatusServiceUnavailable)
+
+	if _, err := gitDaemon.addRepo("health/canary"); err != nil {
+		t.Fatal(err)
+	}
+	// the last result is reused for a while
+	expectStatus("/readyz?deep=1", http.StatusServiceUnavailable)
+	mir.canary.checkedAt = time.Now().Add(-canaryCacheFor)
+	expectStatus("/readyz?deep=1", http.StatusOK)
+
+	mir.warming = 1
+	expectStatus("/healthz", http.StatusOK)
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	mir.warming = 0
+
+	mir.minFreeDisk = 1 << 60
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	mir.minFreeDisk = 0
+
+	mir.basePath = mirBase + "/nonexistent"
+	expectStatus("/healthz", http.StatusServiceUnavailable)
+}
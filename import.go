@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importMirror creates the mirror of repoPath from file, which is either
+// a git bundle or a tarball (optionally gzipped) of a bare repository.
+// It is used to populate base path for offline mode.
+func (s *server) importMirror(repoPath, file string) error {
+	repo, err := s.repository(repoPath)
+	if err != nil {
+		return err
+	}
+	// a namespace cannot be imported without replacing the whole store
+	if repo.namespace != "" {
+		return fmt.Errorf("%s is mirrored into a shared store, which cannot be imported", repoPath)
+	}
+	if repo.exists() {
+		return fmt.Errorf("%s already exists", repo.localDir)
+	}
+
+	parent := filepath.Dir(repo.localDir)
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(parent, filepath.Base(repo.localDir)+tempDirInfix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	isBundle, err := isBundleFile(file)
+	if err != nil {
+		return err
+	}
+
+	gitDir := tmpDir
+	if isBundle {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		gitClone := repo.gitCommand("clone", "--verbose", "--mirror", absFile, ".")
+		gitClone.cmd.Dir = tmpDir
+		if err := gitClone.run(); err != nil {
+			return err
+		}
+	} else {
+		if err := extractTarball(file, tmpDir); err != nil {
+			return err
+		}
+		gitDir, err = findGitDir(tmpDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := repo.verifyDir(gitDir); err != nil {
+		return err
+	}
+
+	rc := s.config.repository(repo.path)
+	if rc.filtersRefs() {
+		if err := repo.removeExcludedRefs(gitDir, rc); err != nil {
+			return err
+		}
+	}
+
+	// for dumb HTTP clients, if served
+	gitUpdateServerInfo := repo.gitCommand("--git-dir=.", "update-server-info")
+	gitUpdateServerInfo.cmd.Dir = gitDir
+	if err := gitUpdateServerInfo.run(); err != nil {
+		return err
+	}
+
+	// point the mirror to upstream, if any, so that it can be synchronized later
+	if s.upstream != "" {
+		gitRemote := repo.gitCommand("--git-dir=.", "remote", "set-url", "origin", repo.upstreamURL)
+		gitRemote.cmd.Dir = gitDir
+		if err := gitRemote.run(); err != nil {
+			gitRemote = repo.gitCommand("--git-dir=.", "remote", "add", "--mirror=fetch", "origin", repo.upstreamURL)
+			gitRemote.cmd.Dir = gitDir
+			if err := gitRemote.run(); err != nil {
+				return err
+			}
+		}
+		if rc.filtersRefs() {
+			if err := repo.setFetchRefspecs(gitDir, rc); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(gitDir, repo.localDir); err != nil {
+		return err
+	}
+
+	logger.Printf("[repo %s] Imported mirror from %s", repo.path, file)
+	return nil
+}
+
+// isBundleFile tells if file is a git bundle by its signature.
+func isBundleFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return line == "# v2 git bundle\n" || line == "# v3 git bundle\n", nil
+}
+
+// extractTarball extracts the tar archive file, which may be gzipped, into dir.
+func extractTarball(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in tarball: %q", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&0777|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			logger.Printf("warning: skipping %q in tarball (type %c)", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// findGitDir returns dir if it is a bare repository,
+// or its only subdirectory if that is, as tarballs often have a top directory.
+func findGitDir(dir string) (string, error) {
+	if isGitDir(dir) {
+		return dir, nil
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(fis) == 1 && fis[0].IsDir() && isGitDir(filepath.Join(dir, fis[0].Name())) {
+		return filepath.Join(dir, fis[0].Name()), nil
+	}
+
+	return "", fmt.Errorf("no bare repository found in tarball")
+}
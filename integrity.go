@@ -0,0 +1,337 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mirrorQuarantined = expvar.NewInt("mirrorQuarantined")
+	mirrorRecloned    = expvar.NewInt("mirrorRecloned")
+	fsckFailed        = expvar.NewInt("fsckFailed")
+	quarantineRemoved = expvar.NewInt("quarantineRemoved")
+)
+
+// quarantineDirName is the directory under base path where broken
+// mirrors are moved for later inspection, in a directory named by the time.
+const quarantineDirName = ".quarantine"
+
+// tempDirInfix is put in the names of temporary directories that mirrors
+// are cloned into before being renamed into place.
+const tempDirInfix = ".mir-tmp-"
+
+// verifyDir checks that dir is a valid git repository.
+// Setting --git-dir keeps git from looking into the parent directories.
+func (repo *repository) verifyDir(dir string) error {
+	gitRevParse := repo.gitCommand("--git-dir=.", "rev-parse", "--git-dir")
+	gitRevParse.cmd.Dir = dir
+	if err := gitRevParse.run(); err != nil {
+		return fmt.Errorf("%s is not a valid git repository: %s", dir, err)
+	}
+	return nil
+}
+
+func (repo *repository) verify() error {
+	return repo.verifyDir(repo.localDir)
+}
+
+// cloneTemp clones repo into a new temporary directory next to repo.localDir,
+// which the caller must rename into place or remove. The clone is filled from
+// a peer if possible, and from upstream otherwise.
+// It does not require locking repo.
+func (s *server) cloneTemp(repo *repository) (string, error) {
+	parent := filepath.Dir(repo.localDir)
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return "", err
+	}
+
+	tmpDir, err := ioutil.TempDir(parent, filepath.Base(repo.localDir)+tempDirInfix)
+	if err != nil {
+		return "", err
+	}
+
+	if repo.namespace != "" {
+		err = repo.initStore(tmpDir)
+	} else if reference := s.forkReference(repo); !s.fillFromPeers(repo, tmpDir, reference) {
+		if rc := s.config.repository(repo.path); rc.filtersRefs() {
+			err = repo.cloneFiltered(tmpDir, rc, reference)
+		} else {
+			args := append([]string{"clone", "--verbose", "--mirror"}, referenceArgs(reference)...)
+			gitClone := repo.upstreamCommand(append(args, repo.upstreamURL, ".")...)
+			gitClone.cmd.Dir = tmpDir
+			err = gitClone.run()
+		}
+	}
+	if err == nil {
+		err = repo.verifyDir(tmpDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	return tmpDir, nil
+}
+
+// removeStaleTempDirs removes temporary directories left by clones
+// interrupted by a crash. It must be called before s starts serving.
+func (s *server) removeStaleTempDirs() error {
+	return filepath.Walk(s.basePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+
+		if strings.Contains(fi.Name(), tempDirInfix) {
+			logger.Printf("Removing stale temporary directory %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+
+		// do not descend into repositories nor the quarantine
+		if fi.Name() == quarantineDirName || isGitDir(path) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// isGitDir roughly tells if dir is a bare repository without running git.
+func isGitDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	return err == nil
+}
+
+// replaceMirror puts the repository at tmpDir into repo.localDir,
+// moving the existing one to the quarantine. Caller must hold the write lock of repo.
+func (s *server) replaceMirror(repo *repository, tmpDir string) error {
+	if repo.storeExists() {
+		quarantineDir := filepath.Join(s.basePath, quarantineDirName, strconv.FormatInt(time.Now().UnixNano(), 10), filepath.FromSlash(repo.path))
+		if err := os.MkdirAll(filepath.Dir(quarantineDir), 0777); err != nil {
+			return err
+		}
+		if err := os.Rename(repo.localDir, quarantineDir); err != nil {
+			return err
+		}
+
+		mirrorQuarantined.Add(1)
+		logger.Printf("[repo %s] Quarantined broken mirror to %s", repo.path, quarantineDir)
+	}
+
+	if err := os.Rename(tmpDir, repo.localDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	atomic.StoreInt64(&repo.bundleBuiltAt, 0)
+	s.refsChanged(repo)
+	return nil
+}
+
+// reclone replaces the broken mirror of repo with a fresh clone. Clients are
+// served from the broken mirror while cloning, as it may still be partially
+// usable, and the write lock of repo is taken only to replace it.
+// Caller must not hold the lock of repo.
+func (s *server) reclone(repo *repository) error {
+	if !atomic.CompareAndSwapInt32(&repo.recloning, 0, 1) {
+		return fmt.Errorf("mirror of %s is being cloned again", repo.path)
+	}
+	defer atomic.StoreInt32(&repo.recloning, 0)
+
+	tmpDir, err := s.cloneTemp(repo)
+	if err != nil {
+		return err
+	}
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	if err := s.replaceMirror(repo, tmpDir); err != nil {
+		return err
+	}
+
+	mirrorRecloned.Add(1)
+	repo.lastSynchronized = time.Now()
+	s.updateServerInfo(repo)
+
+	// the other namespaces are gone with the store replaced by an empty one,
+	// and get synchronized again on demand
+	if repo.namespace != "" {
+		for _, r := range s.repositories() {
+			if r != repo && r.localDir == repo.localDir {
+				s.refsChanged(r)
+			}
+		}
+	}
+	return nil
+}
+
+// recloneLocked is reclone called with the write lock of repo held,
+// which is released while cloning.
+func (s *server) recloneLocked(repo *repository) error {
+	repo.Unlock()
+	defer repo.Lock()
+
+	return s.reclone(repo)
+}
+
+// quarantine is a directory of the mirrors quarantined at a time,
+// named by the UnixNano time.
+type quarantine struct {
+	dir string
+	at  time.Time
+}
+
+// quarantines returns the quarantine directories, the oldest first.
+func (s *server) quarantines() ([]quarantine, error) {
+	dir := filepath.Join(s.basePath, quarantineDirName)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var qs []quarantine
+	for _, fi := range fis {
+		nsec, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		qs = append(qs, quarantine{dir: filepath.Join(dir, fi.Name()), at: time.Unix(0, nsec)})
+	}
+
+	sort.Slice(qs, func(i, j int) bool { return qs[i].at.Before(qs[j].at) })
+	return qs, nil
+}
+
+// removeQuarantine removes the quarantined mirrors in q.
+func removeQuarantine(q quarantine, reason string) error {
+	if err := os.RemoveAll(q.dir); err != nil {
+		return err
+	}
+
+	quarantineRemoved.Add(1)
+	logger.Printf("Removed quarantined mirrors in %s (quarantined at %s, %s)", q.dir, q.at, reason)
+	return nil
+}
+
+// removeExpiredQuarantines removes the mirrors quarantined
+// longer than s.quarantineRetention ago.
+func (s *server) removeExpiredQuarantines() {
+	qs, err := s.quarantines()
+	if err != nil {
+		logger.Printf("Could not list quarantined mirrors: %s", err)
+		return
+	}
+
+	for _, q := range qs {
+		if time.Since(q.at) <= s.quarantineRetention {
+			break
+		}
+		if err := removeQuarantine(q, "expired"); err != nil {
+			logger.Printf("Could not remove quarantined mirrors: %s", err)
+		}
+	}
+}
+
+// fsckLoop periodically checks connectivity of the mirrors
+// which have not been checked for s.fsckInterval.
+func (s *server) fsckLoop() {
+	tick := s.fsckInterval / 10
+	if tick < time.Second {
+		tick = time.Second
+	}
+
+	for range time.Tick(tick) {
+		for _, repo := range s.fsckDueRepositories() {
+			if !atomic.CompareAndSwapInt32(&repo.fscking, 0, 1) {
+				continue
+			}
+
+			repo := repo
+			started := s.goBackground(func() {
+				defer atomic.StoreInt32(&repo.fscking, 0)
+
+				if err := s.checkIntegrity(repo); err != nil {
+					logger.Printf("[repo %s] Could not restore mirror: %s", repo.path, err)
+				}
+			})
+			if !started {
+				atomic.StoreInt32(&repo.fscking, 0)
+			}
+		}
+	}
+}
+
+// fsckDueRepositories returns a repository for each mirror which has not been
+// checked for s.fsckInterval. A shared store is checked once for all the
+// repositories in it, as one of them, and not while any of them is checked.
+func (s *server) fsckDueRepositories() []*repository {
+	mirrors := map[string][]*repository{}
+	for _, repo := range s.repositories() {
+		mirrors[repo.localDir] = append(mirrors[repo.localDir], repo)
+	}
+
+	var due []*repository
+	for _, repos := range mirrors {
+		sort.Slice(repos, func(i, j int) bool { return repos[i].path < repos[j].path })
+
+		var fsckedAt int64
+		fscking := false
+		for _, repo := range repos {
+			if t := atomic.LoadInt64(&repo.fsckedAt); t > fsckedAt {
+				fsckedAt = t
+			}
+			if atomic.LoadInt32(&repo.fscking) != 0 {
+				fscking = true
+			}
+		}
+
+		if !fscking && time.Now().After(time.Unix(0, fsckedAt).Add(s.fsckInterval)) {
+			due = append(due, repos[0])
+		}
+	}
+	return due
+}
+
+// checkIntegrity runs "git fsck --connectivity-only" on the mirror of repo
+// and, if it fails, clones the repository again. For a repository in a shared
+// store the whole store is checked and replaced.
+func (s *server) checkIntegrity(repo *repository) error {
+	defer atomic.StoreInt64(&repo.fsckedAt, time.Now().UnixNano())
+
+	repo.RLock()
+	if !repo.storeExists() {
+		repo.RUnlock()
+		return nil
+	}
+	err := repo.gitCommand("fsck", "--connectivity-only").run()
+	repo.RUnlock()
+
+	if err == nil {
+		return nil
+	}
+
+	fsckFailed.Add(1)
+	logger.Printf("[repo %s] fsck failed, cloning again: %s", repo.path, err)
+
+	return s.reclone(repo)
+}
@@ -4,43 +4,85 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"crypto/sha1"
 	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/golang/groupcache/lru"
 )
 
 var logger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
 
 var (
-	packCacheHit = expvar.NewInt("packCacheHit")
-	syncSkipped  = expvar.NewInt("syncSkipped")
+	packCacheHit         = expvar.NewInt("packCacheHit")
+	packCacheInvalidated = expvar.NewInt("packCacheInvalidated")
+	syncSkipped          = expvar.NewInt("syncSkipped")
+	bundleBuilt          = expvar.NewInt("bundleBuilt")
+	bundleServed         = expvar.NewInt("bundleServed")
+	wantNotFound         = expvar.NewInt("wantNotFound")
 )
 
 var version = "0.4.0"
 
 // repository represents a repository that mir synchronizes.
 // A *repository instance is unique by its path (under a *server),
-// so calling its Lock() makes sense.
+// so calling its Lock() makes sense. Repositories in a shared store
+// share the lock of the store.
 type repository struct {
-	sync.RWMutex
+	*sync.RWMutex
 	path             string
 	upstreamURL      string
+	upstreamHost     string
 	localDir         string
 	lastSynchronized time.Time
+
+	// namespace is the git namespace of repo in the shared store at localDir,
+	// empty if repo has its own mirror
+	namespace string
+
+	// clones counts full clones served, accessed atomically
+	clones int64
+	// bundleBuiltAt is the UnixNano time the clone bundle was last built,
+	// accessed atomically
+	bundleBuiltAt int64
+	bundling      int32
+
+	// maintainedAt is the UnixNano time maintenance last ran,
+	// accessed atomically like syncsSinceMaintenance
+	maintainedAt          int64
+	syncsSinceMaintenance int32
+	maintaining           int32
+
+	fsckedAt int64
+	fscking  int32
+	// recloning is set to non-zero while a broken mirror is cloned again,
+	// accessed atomically
+	recloning int32
+
+	// lastAccessed is the UnixNano time repo was last requested,
+	// accessed atomically
+	lastAccessed int64
+
+	// forcedSyncAt is the UnixNano time repo was last synchronized for
+	// objects wanted by a client and not found, accessed atomically
+	forcedSyncAt int64
+
+	// refState is the hash of the refs of the mirror, or an empty string
+	// if not computed since they changed
+	refState atomic.Value
 }
 
 func (repo *repository) gitCommand(args ...string) repoCommand {
@@ -53,6 +95,31 @@ func (repo *repository) gitCommand(args ...string) repoCommand {
 	}
 }
 
+// upstreamCommand is gitCommand for a command accessing upstream,
+// whose failures may be failures of the upstream host.
+func (repo *repository) upstreamCommand(args ...string) repoCommand {
+	c := repo.gitCommand(args...)
+	c.upstream = true
+	return c
+}
+
+// exists reports whether the local copy of repo has been created.
+// A namespace is created when its HEAD is set, which is never packed.
+func (repo *repository) exists() bool {
+	if repo.namespace != "" {
+		_, err := os.Stat(filepath.Join(repo.localDir, filepath.FromSlash(repo.refName("HEAD"))))
+		return err == nil
+	}
+	return repo.storeExists()
+}
+
+// storeExists reports whether the directory of the local copy of repo exists,
+// which may be shared with other repositories.
+func (repo *repository) storeExists() bool {
+	fi, err := os.Stat(repo.localDir)
+	return err == nil && fi.IsDir()
+}
+
 type server struct {
 	upstream string
 	basePath string
@@ -60,15 +127,79 @@ type server struct {
 	repos struct {
 		sync.Mutex
 		m map[string]*repository
+		// stores are the locks of shared stores
+		stores map[string]*sync.RWMutex
 	}
 
-	packCache    packCache
+	packCache    *packCache
 	refsFreshFor time.Duration
-	// experimental
-	useCachePack bool
+	// minRefsFreshFor bounds the freshness requested by clients
+	minRefsFreshFor time.Duration
+
+	bundleInterval  time.Duration
+	bundleHotClones int64
+
+	maintenanceInterval   time.Duration
+	maintenanceAfterSyncs int
+
+	fsckInterval time.Duration
+
+	maxDiskUsage        byteSize
+	evictIdleAfter      time.Duration
+	quarantineRetention time.Duration
+
+	config *config
+
+	upstreams upstreamHosts
+
+	// offline makes s serve only existing mirrors without synchronizing
+	offline bool
+
+	cluster *cluster
+
+	dumbHTTP bool
+
+	// draining is set to non-zero on shutdown, accessed atomically
+	draining int32
+	// drainMu guards setting draining against adding to background,
+	// so that nothing is added once draining waits for background
+	drainMu sync.Mutex
+	// background tracks the goroutines that draining waits for,
+	// other than HTTP requests
+	background sync.WaitGroup
+
+	// warming is set to non-zero while warming up, accessed atomically
+	warming     int32
+	prewarm     bool
+	minFreeDisk byteSize
+	canaryRepo  string
+	// canary is the last result of the deep readiness check
+	canary struct {
+		sync.Mutex
+		checkedAt time.Time
+		problem   string
+	}
+
+	refsLimiter       rateLimiter
+	uploadPackLimiter rateLimiter
+	rateLimitKeys     []string
+	// fillPeers are the base URLs of mir servers to fill new mirrors from
+	fillPeers []string
+	// peerAddrs are the resolved addresses of the peers in cluster and fillPeers
+	peerAddrs struct {
+		sync.Mutex
+		resolvedAt time.Time
+		addrs      map[string]bool
+	}
 }
 
-func (s *server) repository(repoPath string) *repository {
+// repository returns the repository at repoPath, which must be under s.basePath.
+func (s *server) repository(repoPath string) (*repository, error) {
+	repoPath = strings.TrimSuffix(repoPath, ".git")
+	if err := validateRepositoryPath(repoPath); err != nil {
+		return nil, err
+	}
+
 	s.repos.Lock()
 	defer s.repos.Unlock()
 
@@ -76,123 +207,211 @@ func (s *server) repository(repoPath string) *repository {
 		s.repos.m = map[string]*repository{}
 	}
 
-	repoPath = strings.TrimSuffix(repoPath, ".git")
-
 	repo, ok := s.repos.m[repoPath]
 	if !ok {
 		repo = &repository{
-			path:        repoPath,
-			upstreamURL: s.upstream + repoPath,
+			RWMutex:      &sync.RWMutex{},
+			path:         repoPath,
+			upstreamURL:  s.upstream + repoPath,
+			upstreamHost: upstreamHostOf(s.upstream),
 			// TODO(motemen): escape special characters
 			localDir: filepath.Join(append([]string{s.basePath}, strings.Split(repoPath, "/")...)...),
 		}
+		if store := s.config.repository(repoPath).Store; store != "" {
+			repo.RWMutex = s.storeLock(store)
+			repo.localDir = s.storeDir(store)
+			repo.namespace = namespaceOf(repoPath)
+		}
+		if !isUnder(s.basePath, repo.localDir) {
+			return nil, fmt.Errorf("repository %q is not under base path", repoPath)
+		}
 		s.repos.m[repoPath] = repo
 	}
 
-	return repo
-}
-
-type packCache struct {
-	sync.Mutex
-	*lru.Cache
-}
-
-func (c *packCache) key(repo *repository, clientRequest []byte) string {
-	reqDigest := sha1.Sum(clientRequest)
-	return repo.path + "\000" + string(reqDigest[:])
+	return repo, nil
 }
 
-func (c *packCache) Get(repo *repository, clientRequest []byte) []byte {
-	c.Lock()
-	defer c.Unlock()
+// repositories returns all the repositories s knows at the moment.
+func (s *server) repositories() []*repository {
+	s.repos.Lock()
+	defer s.repos.Unlock()
 
-	key := c.key(repo, clientRequest)
-	if v, ok := c.Cache.Get(key); ok {
-		return v.([]byte)
-	} else {
-		return nil
+	repos := make([]*repository, 0, len(s.repos.m))
+	for _, repo := range s.repos.m {
+		repos = append(repos, repo)
 	}
-}
-
-func (c *packCache) Add(repo *repository, clientRequest []byte, data []byte) {
-	c.Lock()
-	defer c.Unlock()
-
-	key := c.key(repo, clientRequest)
-	c.Cache.Add(key, data)
+	return repos
 }
 
 // synchronizeCache fetches Git content from upstream to synchronize local copy of repo.
-// It does not synchronize if last synchronized time is within s.refsFreshFor from now.
+// It does not synchronize if last synchronized time is within the freshness
+// of repo from now, nor while the upstream host is considered unavailable.
 func (s *server) synchronizeCache(repo *repository) error {
+	return s.synchronizeCacheWithin(repo, s.freshnessFor(repo.path, nil))
+}
+
+// synchronizeCacheWithin is synchronizeCache with the duration to consider refs fresh.
+// A zero freshFor forces synchronization, and pinnedFreshness never
+// synchronizes an existing mirror.
+func (s *server) synchronizeCacheWithin(repo *repository, freshFor time.Duration) (err error) {
 	repo.Lock()
 	defer repo.Unlock()
 
-	if time.Now().Before(repo.lastSynchronized.Add(s.refsFreshFor)) {
+	if s.offline {
+		return nil
+	}
+
+	if freshFor == pinnedFreshness && repo.exists() {
+		syncSkipped.Add(1)
+		return nil
+	}
+
+	freshFor = s.upstreams.refsFreshFor(repo.upstreamHost, freshFor)
+	if time.Now().Before(repo.lastSynchronized.Add(freshFor)) && repo.exists() {
 		syncSkipped.Add(1)
 		logger.Printf("[repo %s] Refs last synchronized at %s, not synchronizing repo", repo.path, repo.lastSynchronized)
 		return nil
 	}
 
+	if err := s.upstreams.allow(repo.upstreamHost); err != nil {
+		return err
+	}
+	// an existing mirror can be served without synchronization,
+	// while an absent one must wait for the budget
+	if err := s.upstreams.spend(repo.upstreamHost, !repo.exists()); err != nil {
+		return err
+	}
+	defer func() { s.upstreams.record(repo.upstreamHost, err) }()
+
+	if repo.namespace != "" {
+		return s.synchronizeNamespace(repo)
+	}
+
 	fi, err := os.Stat(repo.localDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// cache does not exist, so initialize one (may take long)
-			if err := os.MkdirAll(repo.localDir, 0777); err != nil {
+			// cache does not exist, so initialize one (may take long).
+			// clone into a temporary directory so that a crash never
+			// leaves a partial mirror at repo.localDir
+			tmpDir, err := s.cloneTemp(repo)
+			if err != nil {
 				return err
 			}
-
-			gitClone := repo.gitCommand("clone", "--verbose", "--mirror", repo.upstreamURL, ".")
-			err := gitClone.run()
-			if err == nil {
-				repo.lastSynchronized = time.Now()
-			} else {
-				os.Remove(repo.localDir)
+			if err := s.replaceMirror(repo, tmpDir); err != nil {
+				return err
 			}
-			return err
+
+			repo.lastSynchronized = time.Now()
+			atomic.StoreInt64(&repo.maintainedAt, time.Now().UnixNano())
+			s.updateServerInfo(repo)
+			s.scheduleBundle(repo)
+			return nil
 		}
 
 		return err
 	} else if fi != nil && fi.IsDir() {
 		// cache exists, update it
-		// TODO(motemen): check the directory is a valid git repository
-		gitRemoteUpdate := repo.gitCommand("remote", "--verbose", "update")
-		if err := gitRemoteUpdate.run(); err != nil {
+		// check the directory is a valid git repository on its first use
+		// and on failures, as a broken mirror would never be updated
+		if repo.lastSynchronized.IsZero() {
+			if err := repo.verify(); err != nil {
+				logger.Printf("[repo %s] %s, cloning again", repo.path, err)
+				return s.recloneLocked(repo)
+			}
+		}
+
+		changed, err := s.updateMirror(repo)
+		if err != nil {
+			if verr := repo.verify(); verr != nil {
+				logger.Printf("[repo %s] %s, cloning again", repo.path, verr)
+				return s.recloneLocked(repo)
+			}
 			return err
 		}
 		repo.lastSynchronized = time.Now()
+		if !changed {
+			return nil
+		}
+		s.updateServerInfo(repo)
+		s.scheduleBundle(repo)
+		if n := atomic.AddInt32(&repo.syncsSinceMaintenance, 1); s.maintenanceAfterSyncs > 0 && int(n) >= s.maintenanceAfterSyncs {
+			s.scheduleMaintenance(repo)
+		}
 		return nil
 	}
 
 	return fmt.Errorf("could not synchronize cache: %v", repo)
 }
 
+// uploadPackCommand builds a "git upload-pack" command for repo.
+// The protocol version requested by the client is passed through to git
+// unless refs are rewritten, along with the bundle-uri configuration
+// if repo has a clone bundle and the configuration to hide refs.
+func (s *server) uploadPackCommand(repo *repository, req *http.Request, args ...string) repoCommand {
+	rc := s.config.repository(repo.path)
+
+	gitArgs := append(s.bundleURIConfig(repo, req), rc.hideRefsConfig()...)
+	gitArgs = append(gitArgs, "upload-pack")
+	gitArgs = append(gitArgs, args...)
+
+	gitUploadPack := repo.gitCommand(gitArgs...)
+	protocol := req.Header.Get("Git-Protocol")
+	if s.rewritesRefsFor(rc, req) {
+		protocol = ""
+	}
+	gitUploadPack.cmd.Env = repo.uploadPackEnv(protocol)
+	return gitUploadPack
+}
+
+// rewritesRefsFor reports whether the refs advertised to req are rewritten
+// by rc. Peers filling their mirrors get the refs as mirrored.
+func (s *server) rewritesRefsFor(rc repositoryConfig, req *http.Request) bool {
+	return rc.rewritesRefs() && !s.isFillRequest(req)
+}
+
 // advertiseRefs sends the refs list to client.
 // It roughly corresponds to "git ls-remote."
-func (s *server) advertiseRefs(repo *repository, w http.ResponseWriter) {
+func (s *server) advertiseRefs(repo *repository, w http.ResponseWriter, req *http.Request) {
 	// TODO(motemen): Consider serving remote response and move
 	// synchronizeCache to another goroutine. Note we have to implement each
 	// protocol if we do this, as git does not provide ways to obtain raw
 	// git-upload-pack response.
-	if err := s.synchronizeCache(repo); err != nil {
-		logger.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !s.synchronizeOrStale(repo, w, req) {
 		return
 	}
 
+	rc := s.config.repository(repo.path)
+	rewrite := s.rewritesRefsFor(rc, req)
+
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-	fmt.Fprint(w, "001e# service=git-upload-pack\n")
-	fmt.Fprint(w, "0000")
+	w.Header().Set("Cache-Control", "no-cache")
+	// like git-http-backend, protocol v2 responses have no service line.
+	// refs are rewritten only in protocol v0, so v2 is not used then
+	if rewrite || !strings.Contains(req.Header.Get("Git-Protocol"), "version=2") {
+		fmt.Fprint(w, "001e# service=git-upload-pack\n")
+		fmt.Fprint(w, "0000")
+	}
 
 	// do not want to list refs while mirroring, so RLock
 	repo.RLock()
 	defer repo.RUnlock()
 
-	gitUploadPack := repo.gitCommand("upload-pack", "--stateless-rpc", "--advertise-refs", ".")
+	var advertisement bytes.Buffer
+	gitUploadPack := s.uploadPackCommand(repo, req, "--stateless-rpc", "--advertise-refs", ".")
 	gitUploadPack.cmd.Stdout = w
+	if rewrite {
+		gitUploadPack.cmd.Stdout = &advertisement
+	}
 	err := gitUploadPack.run()
 	if err != nil {
 		logger.Println(err)
+		return
+	}
+
+	if rewrite {
+		if err := rewriteAdvertisement(w, &advertisement, rc); err != nil {
+			logger.Println(err)
+		}
 	}
 
 	// no need to return err, as the client knows if something goes wrong
@@ -202,64 +421,73 @@ func (s *server) advertiseRefs(repo *repository, w http.ResponseWriter) {
 // Canonical Git implimentation does interactive negotiation,
 // but for caching purpose this reads all the client's request body
 // and then responds to it.
-func (s *server) uploadPack(repo *repository, w http.ResponseWriter, r io.ReadCloser) {
-	if err := s.synchronizeCache(repo); err != nil {
+func (s *server) uploadPack(repo *repository, w http.ResponseWriter, req *http.Request, r io.ReadCloser) {
+	if !s.synchronizeOrStale(repo, w, req) {
+		return
+	}
+
+	clientRequest, err := ioutil.ReadAll(r)
+	defer r.Close()
+
+	if err != nil {
 		logger.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	uploadPackReq := parseUploadPackRequest(clientRequest)
+	if uploadPackReq.isClone() {
+		atomic.AddInt64(&repo.clones, 1)
+		s.scheduleBundle(repo)
+	}
+
 	repo.RLock()
 	defer repo.RUnlock()
 
-	if s.useCachePack == false {
-		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-		w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
 
-		gitUploadPack := repo.gitCommand("upload-pack", "--stateless-rpc", ".")
-		gitUploadPack.cmd.Stdout = w
-		gitUploadPack.cmd.Stdin = r
-		if err := gitUploadPack.run(); err != nil {
-			logger.Println(err)
+	useCache := s.packCache != nil && uploadPackReq.cacheable()
+	if useCache {
+		if packResponse := s.packCache.Get(repo, clientRequest); packResponse != nil {
+			packCacheHit.Add(1)
+			w.Write(packResponse)
+			return
 		}
-		return
 	}
 
-	clientRequest, err := ioutil.ReadAll(r)
-	defer r.Close()
+	// the client may want objects advertised by another mir in cluster,
+	// which this mirror has not fetched yet
+	if missing := repo.missingObjects(uploadPackReq.wants); len(missing) > 0 && !s.isFillRequest(req) && s.freshnessFor(repo.path, nil) != pinnedFreshness {
+		wantNotFound.Add(1)
+		if s.allowForcedSync(repo) {
+			repo.RUnlock()
 
-	if err != nil {
-		logger.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+			logger.Printf("[repo %s] Wanted objects not found, synchronizing: %v", repo.path, missing)
+			if err := s.synchronizeCacheWithin(repo, 0); err != nil {
+				logger.Println(err)
+			}
 
-	buf := bytes.NewBuffer(clientRequest)
-	// log client capabilities
-	if pkt := newPktLineScanner(buf); pkt.Scan() {
-		line := pkt.Text()
-		// must be 'first-want'
-		// https://github.com/git/git/blob/v2.7.1/Documentation/technical/pack-protocol.txt#L224
-		if strings.HasPrefix(line, "want ") && len(line) > len("want ")+40 && line[len("want ")+40] == ' ' {
-			capabilities := strings.Fields(line[len("want ")+40+1:])
-			logger.Printf("client capabilities: %v", capabilities)
+			repo.RLock()
 		} else {
-			logger.Printf("warning: not a first-want pkt-line: %q", line)
+			logger.Printf("[repo %s] Wanted objects not found, synchronized recently: %v", repo.path, missing)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-	w.Header().Set("Cache-Control", "no-cache")
-
-	if packResponse := s.packCache.Get(repo, clientRequest); packResponse != nil {
-		packCacheHit.Add(1)
-		w.Write(packResponse)
+	if !useCache {
+		gitUploadPack := s.uploadPackCommand(repo, req, "--stateless-rpc", ".")
+		gitUploadPack.cmd.Stdout = w
+		gitUploadPack.cmd.Stdin = bytes.NewBuffer(clientRequest)
+		if err := gitUploadPack.run(); err != nil {
+			logger.Println(err)
+		}
 		return
 	}
 
 	var respBody bytes.Buffer
 
-	gitUploadPack := repo.gitCommand("upload-pack", "--stateless-rpc", ".")
+	start := time.Now()
+	gitUploadPack := s.uploadPackCommand(repo, req, "--stateless-rpc", ".")
 	gitUploadPack.cmd.Stdout = &respBody
 	gitUploadPack.cmd.Stdin = bytes.NewBuffer(clientRequest)
 	if err := gitUploadPack.run(); err != nil {
@@ -267,25 +495,157 @@ func (s *server) uploadPack(repo *repository, w http.ResponseWriter, r io.ReadCl
 		return
 	}
 
-	s.packCache.Add(repo, clientRequest, respBody.Bytes())
+	s.packCache.Add(repo, clientRequest, respBody.Bytes(), time.Since(start))
 	io.Copy(w, &respBody)
 }
 
+// allowForcedSync reports whether refs of repo may be synchronized now
+// regardless of their freshness, which is allowed once per the minimum
+// freshness of repo so that clients cannot force synchronizations on
+// every request.
+func (s *server) allowForcedSync(repo *repository) bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&repo.forcedSyncAt)
+	if now-last < int64(s.minFreshnessFor(repo.path)) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&repo.forcedSyncAt, last, now)
+}
+
+// missingObjects returns the objects in names that repo does not have.
+// Caller must hold the read lock of repo.
+func (repo *repository) missingObjects(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	gitCatFile := repo.gitCommand("cat-file", "--batch-check")
+	gitCatFile.cmd.Stdin = strings.NewReader(strings.Join(names, "\n") + "\n")
+	gitCatFile.cmd.Stdout = &out
+	if err := gitCatFile.run(); err != nil {
+		logger.Println(err)
+		return nil
+	}
+
+	var missing []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasSuffix(line, " missing") {
+			missing = append(missing, strings.TrimSuffix(line, " missing"))
+		}
+	}
+	return missing
+}
+
+// uploadPackRequest is a parsed client request to git-upload-pack.
+type uploadPackRequest struct {
+	// command is the protocol v2 command, empty for protocol v0/v1
+	command      string
+	wants        []string
+	haves        int
+	capabilities []string
+}
+
+// parseUploadPackRequest reads the pkt-lines of clientRequest.
+// https://github.com/git/git/blob/v2.39.0/Documentation/technical/protocol-v2.txt
+func parseUploadPackRequest(clientRequest []byte) uploadPackRequest {
+	var upr uploadPackRequest
+
+	pkt := newPktLineScanner(bytes.NewReader(clientRequest))
+	for i := 0; pkt.Scan(); i++ {
+		line := strings.TrimSuffix(pkt.Text(), "\n")
+		if i == 0 && strings.HasPrefix(line, "command=") {
+			upr.command = strings.TrimPrefix(line, "command=")
+			continue
+		}
+
+		if strings.HasPrefix(line, "want ") && len(line) >= len("want ")+40 {
+			upr.wants = append(upr.wants, line[len("want "):len("want ")+40])
+			// must be 'first-want'
+			// https://github.com/git/git/blob/v2.7.1/Documentation/technical/pack-protocol.txt#L224
+			if i == 0 && upr.command == "" {
+				upr.capabilities = strings.Fields(line[len("want ")+40:])
+				logger.Printf("client capabilities: %v", upr.capabilities)
+			}
+		} else if strings.HasPrefix(line, "have ") {
+			upr.haves++
+		} else if i == 0 && upr.command == "" {
+			logger.Printf("warning: not a first-want pkt-line: %q", line)
+		}
+	}
+
+	return upr
+}
+
+// isClone reports whether the request is a full clone, that is,
+// wants something without having anything.
+func (upr uploadPackRequest) isClone() bool {
+	return (upr.command == "" || upr.command == "fetch") && len(upr.wants) > 0 && upr.haves == 0
+}
+
+// cacheable reports whether the response to the request depends only on
+// the objects requested, not the refs at the time.
+func (upr uploadPackRequest) cacheable() bool {
+	return upr.command == "" || upr.command == "fetch"
+}
+
 var expvarHandler = expvar.Handler()
 
+// requestedRepository returns the repository at the request path
+// without suffix, or nil after responding if it is not served by s:
+// routed to another peer in cluster, or not found.
+func (s *server) requestedRepository(w http.ResponseWriter, req *http.Request, suffix string) *repository {
+	repoPath := strings.TrimSuffix(req.URL.Path[1:], suffix)
+	if err := validateRepositoryPath(strings.TrimSuffix(repoPath, ".git")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if s.cluster != nil && !s.isFromPeer(req) && s.cluster.route(w, req, repoPath) {
+		return nil
+	}
+
+	repo, err := s.repository(repoPath)
+	if err != nil {
+		logger.Printf("[request %p] %s", req, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	// offline mode and peers filling serve only the repositories on disk
+	if (s.offline || s.isFillRequest(req)) && !repo.exists() {
+		http.NotFound(w, req)
+		return nil
+	}
+
+	repo.touch()
+	return repo
+}
+
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	logger.Printf("[request %p] %s %s %v", req, req.Method, req.URL, req.Header)
 
 	if strings.HasSuffix(req.URL.Path, "/info/refs") && req.URL.Query().Get("service") == "git-upload-pack" {
 		// mode: ref discovery
-		repoPath := strings.TrimSuffix(req.URL.Path[1:], "/info/refs")
-		repo := s.repository(repoPath)
+		if s.throttle(w, req, &s.refsLimiter, "refs", strings.TrimSuffix(req.URL.Path[1:], "/info/refs")) {
+			return
+		}
+
+		repo := s.requestedRepository(w, req, "/info/refs")
+		if repo == nil {
+			return
+		}
 
-		s.advertiseRefs(repo, w)
+		s.advertiseRefs(repo, w, req)
 	} else if req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/git-upload-pack") {
 		// mode: upload-pack
-		repoPath := strings.TrimSuffix(req.URL.Path[1:], "/git-upload-pack")
-		repo := s.repository(repoPath)
+		if s.throttle(w, req, &s.uploadPackLimiter, "upload-pack", strings.TrimSuffix(req.URL.Path[1:], "/git-upload-pack")) {
+			return
+		}
+
+		repo := s.requestedRepository(w, req, "/git-upload-pack")
+		if repo == nil {
+			return
+		}
 
 		r := req.Body
 		if req.Header.Get("Content-Encoding") == "gzip" {
@@ -298,7 +658,35 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		s.uploadPack(repo, w, r)
+		s.uploadPack(repo, w, req, r)
+	} else if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/"+cloneBundleName) {
+		// mode: pre-generated bundle, as costly as an upload-pack
+		if s.throttle(w, req, &s.uploadPackLimiter, "upload-pack", strings.TrimSuffix(req.URL.Path[1:], "/"+cloneBundleName)) {
+			return
+		}
+
+		repo := s.requestedRepository(w, req, "/"+cloneBundleName)
+		if repo == nil {
+			return
+		}
+
+		s.serveBundle(repo, w, req)
+	} else if m := dumbHTTPPath.FindStringSubmatch(req.URL.Path); s.dumbHTTP && m != nil && (req.Method == "GET" || req.Method == "HEAD") && req.URL.Query().Get("service") == "" {
+		// mode: dumb HTTP, whose refs synchronize as ref discovery does
+		if (m[2] == "info/refs" || m[2] == "HEAD") && s.throttle(w, req, &s.refsLimiter, "refs", m[1]) {
+			return
+		}
+
+		repo := s.requestedRepository(w, req, "/"+m[2])
+		if repo == nil {
+			return
+		}
+
+		s.serveDumb(repo, w, req, m[2])
+	} else if req.Method == "GET" && req.URL.Path == "/healthz" {
+		s.serveHealthz(w, req)
+	} else if req.Method == "GET" && req.URL.Path == "/readyz" {
+		s.serveReadyz(w, req)
 	} else if req.Method == "GET" && req.URL.Path == "/debug/vars" {
 		expvarHandler.ServeHTTP(w, req)
 	} else {
@@ -308,19 +696,78 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func main() {
 	var (
-		s            server
-		listen       string
-		numPackCache int
-		printVersion bool
+		s                      server
+		listen                 string
+		listenGit              string
+		listenSSH              string
+		sshHostKey             string
+		sshAuthorizedKeys      string
+		tlsCert                string
+		tlsKey                 string
+		tlsClientCA            string
+		packCacheBytes         byteSize
+		packCacheMaxEntryBytes = byteSize(64 << 20)
+		packCachePolicy        = packCacheLRU
+		numPackCache           int
+		configFile             string
+		peers                  string
+		self                   string
+		replicas               int
+		peerRedirect           bool
+		drainTimeout           time.Duration
+		maxGitProcs            int
+		rateLimitKey           string
+		fillPeers              string
+		printVersion           bool
 	)
 	flag.StringVar(&s.upstream, "upstream", "", "upstream repositories' base `URL`")
 	flag.StringVar(&s.basePath, "base-path", "", "base `directory` for locally cloned repositories")
 	flag.StringVar(&listen, "listen", ":9280", "`address` to listen to")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate `file` to serve HTTPS with, reloaded on change")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key `file` for -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle `file` to verify client certificates with (requires -tls-cert)")
+	flag.StringVar(&listenGit, "listen-git", "", "`address` to listen to for native Git protocol (git://), like :9418")
+	flag.StringVar(&listenSSH, "listen-ssh", "", "`address` to listen to for SSH, like :2222 (requires -ssh-host-key and -ssh-authorized-keys)")
+	flag.StringVar(&sshHostKey, "ssh-host-key", "", "private host key `file` of the SSH server")
+	flag.StringVar(&sshAuthorizedKeys, "ssh-authorized-keys", "", "authorized_keys `file` of the keys allowed over SSH, reloaded on change")
 	flag.DurationVar(&s.refsFreshFor, "refs-fresh-for", 5*time.Second, "`duration` to consider synchronized refs (keep this very short)")
-	flag.IntVar(&numPackCache, "num-pack-cache", 20, "`number` of pack caches to keep in memory")
+	flag.DurationVar(&s.minRefsFreshFor, "min-refs-fresh-for", time.Second, "minimum `duration` to consider synchronized refs fresh that clients can request with ?fresh= or the "+freshnessHeader+" header")
+	flag.Var(&packCacheBytes, "pack-cache-bytes", "total `size` of pack caches to keep in memory, like 256M, enabling the experimental pack cache (default disabled)")
+	flag.Var(&packCacheMaxEntryBytes, "pack-cache-max-entry-bytes", "maximum `size` of a pack to cache (0 for no limit but -pack-cache-bytes)")
+	flag.IntVar(&numPackCache, "num-pack-cache", 0, "deprecated: use -pack-cache-bytes; 0 disables the pack cache, other `number`s are ignored")
+	flag.Var(&packCachePolicy, "pack-cache-policy", "`policy` to evict pack caches by: \"lru\" or \"cost\", favoring packs expensive to generate per byte")
+	flag.DurationVar(&s.bundleInterval, "bundle-interval", 0, "`duration` between rebuilding clone bundles of hot repositories (0 to disable bundles)")
+	flag.Int64Var(&s.bundleHotClones, "bundle-hot-clones", 2, "`number` of full clones after which a repository is considered hot and gets a clone bundle")
+	flag.DurationVar(&s.maintenanceInterval, "maintenance-interval", 0, "`duration` between maintenance (repack, commit-graph) of each repository (0 to disable)")
+	flag.IntVar(&s.maintenanceAfterSyncs, "maintenance-after-syncs", 0, "`number` of synchronizations after which a repository gets maintenance (0 to disable)")
+	flag.DurationVar(&s.fsckInterval, "fsck-interval", 0, "`duration` between connectivity checks of each repository, which get cloned again if broken (0 to disable)")
+	flag.Var(&s.maxDiskUsage, "max-disk-usage", "`size` of mirrors (like 100G) above which least recently used ones are evicted (0 for no limit)")
+	flag.DurationVar(&s.evictIdleAfter, "evict-idle-after", 0, "`duration` after which mirrors not accessed are evicted (0 to disable)")
+	flag.DurationVar(&s.quarantineRetention, "quarantine-retention", 7*24*time.Hour, "`duration` to keep broken mirrors in quarantine for inspection (0 to keep them unless -max-disk-usage is exceeded)")
+	flag.IntVar(&s.upstreams.failureThreshold, "upstream-failure-threshold", 3, "`number` of consecutive failures to synchronize from an upstream host before backing off (0 to never back off)")
+	flag.DurationVar(&s.upstreams.maxBackoff, "upstream-max-backoff", 5*time.Minute, "maximum `duration` to back off from a failing upstream host")
+	flag.Var(&s.upstreams.limit, "upstream-rate", "`rate` of synchronizations per upstream host, like \"100/m\" or \"1/s:10\" (default unlimited)")
+	flag.DurationVar(&s.upstreams.maxRefsFreshFor, "upstream-max-refs-fresh-for", time.Hour, "maximum `duration` to extend the freshness of refs to while an upstream host is rate limiting (0 to never extend)")
+	flag.BoolVar(&s.offline, "offline", false, "serve only repositories under base path, never accessing upstream")
+	flag.StringVar(&peers, "peers", "", "comma-separated base `URLs` of mir servers in cluster, including self")
+	flag.StringVar(&self, "self", "", "base `URL` of this server in -peers")
+	flag.IntVar(&replicas, "replicas", 1, "`number` of peers in cluster that mirror each repository")
+	flag.BoolVar(&peerRedirect, "peer-redirect", false, "redirect clients to the owner peer instead of proxying")
+	flag.StringVar(&fillPeers, "fill-peers", "", "comma-separated base `URLs` of mir servers to fill new mirrors from before upstream (defaults to -peers)")
+	flag.BoolVar(&s.dumbHTTP, "dumb-http", false, "serve Git dumb HTTP protocol as well")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "`duration` to wait for in-flight requests and synchronizations on SIGTERM before exiting")
+	flag.BoolVar(&s.prewarm, "prewarm", false, "synchronize the mirrors under base path at startup, reporting not ready meanwhile")
+	flag.Var(&s.minFreeDisk, "min-free-disk", "free disk `size` of base path below which mir reports not ready")
+	flag.IntVar(&maxGitProcs, "max-git-processes", 0, "maximum `number` of git processes running at once, above which mir reports not ready (0 for no limit)")
+	flag.StringVar(&s.canaryRepo, "canary-repo", "", "repository `path` in upstream to list refs of for /readyz?deep=1")
+	flag.Var(&s.refsLimiter.limit, "rate-limit-refs", "`rate` of ref advertisements allowed per client, like 10/s or 100/m:20 (with burst)")
+	flag.Var(&s.uploadPackLimiter.limit, "rate-limit-upload-pack", "`rate` of upload-packs allowed per client, like 10/s or 100/m:20 (with burst)")
+	flag.StringVar(&rateLimitKey, "rate-limit-key", "ip", "comma-separated `parts` identifying a client for rate limits: ip, identity and/or repo")
+	flag.StringVar(&configFile, "config", "", "configuration `file` in JSON")
 	flag.BoolVar(&printVersion, "version", false, "print version and exit")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s -listen=<addr> -upstream=<url> -base-path=<path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -base-path=<path> [-upstream=<url>] [-config=<file>] import <repo> <bundle-or-tarball>\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -330,18 +777,176 @@ func main() {
 		os.Exit(0)
 	}
 
-	if s.upstream == "" || s.basePath == "" {
+	// the pack cache used to be limited by the number of entries
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "num-pack-cache" {
+			return
+		}
+		if numPackCache == 0 {
+			logger.Printf("-num-pack-cache is deprecated, disabling the pack cache; it is disabled unless -pack-cache-bytes is set")
+			packCacheBytes = 0
+		} else {
+			logger.Printf("-num-pack-cache is deprecated and ignored; use -pack-cache-bytes to enable the pack cache")
+		}
+	})
+
+	if configFile != "" {
+		var err error
+		s.config, err = loadConfig(configFile)
+		if err != nil {
+			logger.Fatalf("could not load config: %s", err)
+		}
+	}
+
+	if flag.Arg(0) == "import" {
+		if s.basePath == "" || flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if err := s.importMirror(flag.Arg(1), flag.Arg(2)); err != nil {
+			logger.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if (s.upstream == "" && !s.offline) || s.basePath == "" || (tlsCert == "") != (tlsKey == "") || (tlsClientCA != "" && tlsCert == "") || (listenSSH != "" && (sshHostKey == "" || sshAuthorizedKeys == "")) {
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	s.packCache.Cache = lru.New(numPackCache)
+	if peers != "" {
+		var err error
+		s.cluster, err = newCluster(self, strings.Split(peers, ","), replicas, peerRedirect)
+		if err != nil {
+			logger.Fatalf("could not form cluster: %s", err)
+		}
+	}
+
+	if fillPeers != "" {
+		s.fillPeers = strings.Split(fillPeers, ",")
+	} else if s.cluster != nil {
+		s.fillPeers = s.cluster.peers()
+	}
+	for i, peer := range s.fillPeers {
+		s.fillPeers[i] = strings.TrimSuffix(peer, "/")
+	}
+
+	if packCacheBytes > 0 {
+		s.packCache = newPackCache(int64(packCacheBytes), int64(packCacheMaxEntryBytes), packCachePolicy)
+	}
+
+	if err := s.removeStaleTempDirs(); err != nil {
+		logger.Printf("could not remove stale temporary directories: %s", err)
+	}
+
+	if s.maintenanceInterval > 0 {
+		go s.maintenanceLoop()
+	}
+	if s.fsckInterval > 0 {
+		go s.fsckLoop()
+	}
+	setMaxCommands(maxGitProcs)
+	expvar.Publish("upstreamPressure", expvar.Func(s.upstreams.pressures))
 
-	logger.Printf("[server %p] mir %s starting at %s ...", &s, version, listen)
+	for _, k := range strings.Split(rateLimitKey, ",") {
+		if k != "ip" && k != "identity" && k != "repo" {
+			logger.Fatalf("invalid -rate-limit-key: %q", k)
+		}
+		s.rateLimitKeys = append(s.rateLimitKeys, k)
+	}
 
-	err := http.ListenAndServe(listen, &s)
+	s.startWarmUp()
+
+	if s.maxDiskUsage > 0 || s.evictIdleAfter > 0 || s.quarantineRetention > 0 {
+		go s.evictionLoop()
+	}
+
+	// listeners may be passed by systemd socket activation or the previous
+	// process for zero-downtime restarts: the first for HTTP, the second for
+	// git:// and the third for SSH
+	listeners, err := systemdListeners()
 	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var httpListener, gitListener net.Listener
+	if len(listeners) > 0 {
+		httpListener = listeners[0]
+	} else if httpListener, err = net.Listen("tcp", listen); err != nil {
+		logger.Fatal(err)
+	}
+	if len(listeners) > 1 {
+		gitListener = listeners[1]
+	} else if listenGit != "" {
+		if gitListener, err = net.Listen("tcp", listenGit); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if gitListener != nil {
+		logger.Printf("[server %p] serving git:// at %s ...", &s, gitListener.Addr())
+		go func() {
+			logger.Println(s.serveGitDaemon(gitListener))
+		}()
+	}
+
+	var sshListener net.Listener
+	if len(listeners) > 2 {
+		sshListener = listeners[2]
+	} else if listenSSH != "" {
+		if sshListener, err = net.Listen("tcp", listenSSH); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if sshListener != nil {
+		keys, err := newAuthorizedKeys(sshAuthorizedKeys)
+		if err != nil {
+			logger.Fatalf("could not load SSH authorized keys: %s", err)
+		}
+		config, err := newSSHServerConfig(sshHostKey, keys)
+		if err != nil {
+			logger.Fatalf("could not load SSH host key: %s", err)
+		}
+
+		logger.Printf("[server %p] serving SSH at %s ...", &s, sshListener.Addr())
+		go func() {
+			logger.Println(s.serveSSH(sshListener, config))
+		}()
+	}
+
+	logger.Printf("[server %p] mir %s starting at %s ...", &s, version, httpListener.Addr())
+
+	srv := &http.Server{Handler: &s}
+
+	errc := make(chan error, 1)
+	if tlsCert != "" {
+		r, err := newTLSReloader(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			logger.Fatalf("could not load TLS certificates: %s", err)
+		}
+		srv.TLSConfig = r.tlsConfig()
+
+		go func() { errc <- srv.ServeTLS(httpListener, "", "") }()
+	} else {
+		go func() { errc <- srv.Serve(httpListener) }()
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errc:
 		logger.Println(err)
+		os.Exit(1)
+	case sig := <-sigc:
+		logger.Printf("[server %p] received %s, draining ...", &s, sig)
+		if err := s.drain(srv, []net.Listener{gitListener, sshListener}, drainTimeout); err != nil {
+			logger.Println(err)
+			os.Exit(1)
+		}
+		logger.Printf("[server %p] drained, exiting", &s)
 	}
 }
 
@@ -356,18 +961,33 @@ func splitPktLine(data []byte, atEOF bool) (advance int, token []byte, err error
 		return
 	}
 
+	if len(data) < 4 {
+		if atEOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
 	var n int64
 	n, err = strconv.ParseInt(string(data[0:4]), 16, 32)
 	if err != nil {
 		return
 	}
 
-	if n == 0 {
+	// flush-pkt (0000), delim-pkt (0001) and response-end-pkt (0002)
+	if n < 4 {
 		advance = 4
 		token = []byte{}
 		return
 	}
 
+	if len(data) < int(n) {
+		if atEOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
 	advance = int(n)
 	token = data[4:n]
 	return
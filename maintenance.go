@@ -0,0 +1,98 @@
+package main
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maintenanceRun    = expvar.NewInt("maintenanceRun")
+	maintenanceFailed = expvar.NewInt("maintenanceFailed")
+	// maintenanceLastDuration maps repository paths to the time
+	// their last maintenance took, in seconds
+	maintenanceLastDuration = expvar.NewMap("maintenanceLastDuration")
+)
+
+// maintenanceCommands are run in order to keep mirrors fast to serve:
+// one pack with reachability bitmaps, a commit-graph and a multi-pack-index.
+var maintenanceCommands = [][]string{
+	{"repack", "-a", "-d", "-b"},
+	{"commit-graph", "write", "--reachable"},
+	{"multi-pack-index", "write"},
+}
+
+// maintenanceLoop periodically runs maintenance of the repositories
+// which have not been maintained for s.maintenanceInterval.
+func (s *server) maintenanceLoop() {
+	tick := s.maintenanceInterval / 10
+	if tick < time.Second {
+		tick = time.Second
+	}
+
+	for range time.Tick(tick) {
+		for _, repo := range s.repositories() {
+			maintainedAt := time.Unix(0, atomic.LoadInt64(&repo.maintainedAt))
+			if time.Now().After(maintainedAt.Add(s.maintenanceInterval)) {
+				s.scheduleMaintenance(repo)
+			}
+		}
+	}
+}
+
+// scheduleMaintenance starts maintenance of repo in background
+// unless it is already running.
+func (s *server) scheduleMaintenance(repo *repository) {
+	if !atomic.CompareAndSwapInt32(&repo.maintaining, 0, 1) {
+		return
+	}
+
+	started := s.goBackground(func() {
+		defer atomic.StoreInt32(&repo.maintaining, 0)
+
+		if err := s.runMaintenance(repo); err != nil {
+			maintenanceFailed.Add(1)
+			logger.Printf("[repo %s] Maintenance failed: %s", repo.path, err)
+		}
+	})
+	if !started {
+		atomic.StoreInt32(&repo.maintaining, 0)
+	}
+}
+
+// runMaintenance repacks repo and writes auxiliary indices.
+// As repacking removes packs which git-upload-pack may be reading,
+// it takes the write lock of repo.
+func (s *server) runMaintenance(repo *repository) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if !repo.exists() {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		atomic.StoreInt64(&repo.maintainedAt, time.Now().UnixNano())
+		atomic.StoreInt32(&repo.syncsSinceMaintenance, 0)
+		maintenanceLastDuration.Set(repo.path, expvarFloat(time.Since(start).Seconds()))
+	}()
+
+	maintenanceRun.Add(1)
+	for _, args := range s.maintenanceCommandsFor(repo) {
+		if err := repo.gitCommand(args...).run(); err != nil {
+			return err
+		}
+	}
+
+	// packs have changed
+	s.updateServerInfo(repo)
+
+	return nil
+}
+
+func expvarFloat(f float64) *expvar.Float {
+	v := new(expvar.Float)
+	v.Set(f)
+	return v
+}
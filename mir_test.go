@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -20,7 +21,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/groupcache/lru"
 	"github.com/pkg/errors"
 )
 
@@ -173,7 +173,6 @@ func TestMir_Smoke(t *testing.T) {
 		upstream:     fmt.Sprintf("git://localhost:%d/", gitDaemon.port),
 		refsFreshFor: 50 * time.Millisecond,
 	}
-	mir.packCache.Cache = lru.New(20)
 
 	s := httptest.NewServer(&mir)
 	defer s.Close()
@@ -320,12 +319,12 @@ func TestMir_Scaled(t *testing.T) {
 	}
 
 	// then sync 1 only
-	err = runCommand("git", "fetch", s1.URL+"/foo/bar.git")
+	err = runCommand("git", "-C", wd, "fetch", s1.URL+"/foo/bar.git")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	out, err := runCommandOutput("git", "rev-parse", "FETCH_HEAD")
+	out, err := runCommandOutput("git", "-C", wd, "rev-parse", "FETCH_HEAD")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -357,6 +356,1409 @@ func TestMir_Scaled(t *testing.T) {
 	}
 }
 
+// tempDir creates a temporary directory, which is removed when t finishes.
+func tempDir(t *testing.T, prefix string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestMir creates a mir server mirroring the repositories of gitDaemon
+// into a temporary base path, configured by configure if not nil.
+func newTestMir(t *testing.T, configure func(mir *server)) *server {
+	t.Helper()
+
+	mir := &server{
+		basePath: tempDir(t, "mir-test-base"),
+		upstream: fmt.Sprintf("git://localhost:%d/", gitDaemon.port),
+	}
+	if configure != nil {
+		configure(mir)
+	}
+	return mir
+}
+
+// newTestServer is newTestMir with an HTTP server serving it,
+// which is closed when t finishes.
+func newTestServer(t *testing.T, configure func(mir *server)) (*server, *httptest.Server) {
+	t.Helper()
+
+	mir := newTestMir(t, configure)
+	s := httptest.NewServer(mir)
+	t.Cleanup(s.Close)
+	return mir, s
+}
+
+// serveTestGitDaemon serves git:// from mir until t finishes,
+// returning the address to connect to.
+func serveTestGitDaemon(t *testing.T, mir *server) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go mir.serveGitDaemon(l)
+	return l.Addr().String()
+}
+
+// mirRepository returns the repository of mir at repoPath.
+func mirRepository(t *testing.T, mir *server, repoPath string) *repository {
+	t.Helper()
+
+	repo, err := mir.repository(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// gitDaemonFirstLine sends a request for git-upload-pack of path to the git://
+// server at addr, and returns the first pkt-line of the response.
+func gitDaemonFirstLine(t *testing.T, addr, path string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := "git-upload-pack " + path + "\000host=localhost\000"
+	if _, err := fmt.Fprintf(conn, "%04x%s", len(request)+4, request); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := readPktLine(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+// head returns the object name HEAD of r points to.
+func (r upstreamRepo) head() (string, error) {
+	out, err := runCommandOutput("git", "--git-dir", string(r), "rev-parse", "HEAD")
+	return strings.TrimSpace(out.String()), err
+}
+
+// uploadPackWant requests rev from git-upload-pack of repoURL without ref
+// discovery, as a client of another peer in cluster would, and returns
+// the first pkt-line of the response.
+func uploadPackWant(t *testing.T, repoURL, rev string) string {
+	t.Helper()
+
+	resp, err := http.Post(
+		repoURL+"/git-upload-pack",
+		"",
+		bytes.NewBufferString(
+			"003ewant "+rev+" no-progress\n"+
+				"0000"+
+				"0009done\n",
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	pkt := newPktLineScanner(resp.Body)
+	if !pkt.Scan() {
+		t.Fatalf("no response (%d): %v", resp.StatusCode, pkt.Err())
+	}
+	return pkt.Text()
+}
+
+func TestMir_Bundle(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	if _, err := gitDaemon.addRepo("foo/bundle"); err != nil {
+		t.Fatal(err)
+	}
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.refsFreshFor = 50 * time.Millisecond
+		mir.bundleInterval = time.Hour
+		mir.bundleHotClones = 1
+	})
+
+	resp, err := http.Get(s.URL + "/foo/bundle.git/clone.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d before any clone", resp.StatusCode)
+	}
+
+	err = runCommand("git", "-c", "protocol.version=2", "clone", "--quiet", s.URL+"/foo/bundle.git", filepath.Join(wd, "clone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := mirRepository(t, mir, "foo/bundle")
+	for i := 0; !repo.hasBundle(); i++ {
+		if i > 100 {
+			t.Fatal("bundle was not built")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	resp, err = http.Get(s.URL + "/foo/bundle.git/clone.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bundleFile := filepath.Join(wd, "clone.bundle")
+	f, err := os.Create(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runCommand("git", "clone", "--quiet", bundleFile, filepath.Join(wd, "unbundled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMir_Maintenance(t *testing.T) {
+	if _, err := gitDaemon.addRepo("foo/maintenance"); err != nil {
+		t.Fatal(err)
+	}
+
+	mir := newTestMir(t, nil)
+
+	repo := mirRepository(t, mir, "foo/maintenance")
+	if err := mir.synchronizeCache(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mir.runMaintenance(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []string{
+		"objects/pack/*.bitmap",
+		"objects/pack/multi-pack-index",
+		"objects/info/commit-graph",
+	} {
+		matches, err := filepath.Glob(filepath.Join(repo.localDir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 {
+			t.Errorf("%s not found after maintenance", pattern)
+		}
+	}
+}
+
+func TestMir_BrokenMirror(t *testing.T) {
+	if _, err := gitDaemon.addRepo("foo/broken"); err != nil {
+		t.Fatal(err)
+	}
+
+	mir := newTestMir(t, nil)
+
+	repo := mirRepository(t, mir, "foo/broken")
+	if err := mir.synchronizeCache(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// not a repository anymore
+	if err := os.RemoveAll(filepath.Join(repo.localDir, "objects")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mir.synchronizeCache(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a repository with objects missing
+	packs, err := filepath.Glob(filepath.Join(repo.localDir, "objects", "pack", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pack := range packs {
+		os.Remove(pack)
+	}
+
+	if err := mir.checkIntegrity(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.gitCommand("fsck", "--connectivity-only").run(); err != nil {
+		t.Fatal(err)
+	}
+
+	quarantined, err := filepath.Glob(filepath.Join(mir.basePath, quarantineDirName, "*", "foo", "broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 {
+		t.Errorf("got %d quarantined mirrors, expected 2", len(quarantined))
+	}
+
+	mir.quarantineRetention = time.Hour
+	mir.removeExpiredQuarantines()
+	if qs, _ := mir.quarantines(); len(qs) != 2 {
+		t.Errorf("got %d quarantines before retention, expected 2", len(qs))
+	}
+
+	mir.quarantineRetention = time.Nanosecond
+	mir.removeExpiredQuarantines()
+	if qs, _ := mir.quarantines(); len(qs) != 0 {
+		t.Errorf("got %d quarantines after retention, expected 0", len(qs))
+	}
+}
+
+func TestMir_AtomicClone(t *testing.T) {
+	mir := newTestMir(t, nil)
+
+	repo := mirRepository(t, mir, "foo/nonexistent")
+	if err := mir.synchronizeCache(repo); err == nil {
+		t.Fatal("expected error for nonexistent upstream")
+	}
+	if _, err := os.Stat(repo.localDir); !os.IsNotExist(err) {
+		t.Fatalf("failed clone left %s: %v", repo.localDir, err)
+	}
+
+	staleDir := filepath.Join(mir.basePath, "foo", "bar"+tempDirInfix+"12345")
+	if err := os.MkdirAll(filepath.Join(staleDir, "objects"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mir.removeStaleTempDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staleDir); !os.IsNotExist(err) {
+		t.Fatalf("stale directory %s not removed: %v", staleDir, err)
+	}
+}
+
+func TestMir_Eviction(t *testing.T) {
+	for _, path := range []string{"evict/pinned", "evict/unpinned"} {
+		if _, err := gitDaemon.addRepo(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mir := newTestMir(t, func(mir *server) {
+		mir.maxDiskUsage = 1
+		mir.config = &config{
+			Repositories: []repositoryConfig{
+				{Path: "evict/pinned", Pinned: true},
+			},
+		}
+	})
+
+	pinned, unpinned := mirRepository(t, mir, "evict/pinned"), mirRepository(t, mir, "evict/unpinned")
+	for _, repo := range []*repository{pinned, unpinned} {
+		repo.touch()
+		if err := mir.synchronizeCache(repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quarantined := filepath.Join(mir.basePath, quarantineDirName, "1", "evict", "broken")
+	if err := os.MkdirAll(quarantined, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(quarantined, "HEAD"), []byte("ref: refs/heads/master\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	mir.evictRepositories()
+
+	if _, err := os.Stat(quarantined); !os.IsNotExist(err) {
+		t.Errorf("quarantined mirror not removed over quota: %v", err)
+	}
+	if !pinned.exists() {
+		t.Error("pinned repository evicted")
+	}
+	if unpinned.exists() {
+		t.Error("repository not evicted")
+	}
+
+	if err := mir.synchronizeCache(unpinned); err != nil {
+		t.Fatal(err)
+	}
+	if !unpinned.exists() {
+		t.Error("evicted repository not cloned again")
+	}
+
+	// accessed after selected for eviction
+	selected := unpinned.lastAccessedAt()
+	time.Sleep(time.Millisecond)
+	unpinned.touch()
+	evicted := mirrorEvicted.Value()
+	totalSize := mir.evictCandidates([]evictionCandidate{{unpinned, 100, selected}}, 100)
+	if !unpinned.exists() {
+		t.Error("repository accessed after selected evicted")
+	}
+	if mirrorEvicted.Value() != evicted || totalSize != 100 {
+		t.Errorf("repository accessed after selected counted as evicted: total size %d", totalSize)
+	}
+}
+
+func TestMir_StaleMirror(t *testing.T) {
+	if _, err := gitDaemon.addRepo("foo/stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadPort, err := emptyPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.upstreams.failureThreshold = 1
+		mir.upstreams.maxBackoff = time.Minute
+	})
+
+	repo := mirRepository(t, mir, "foo/stale")
+	if err := mir.synchronizeCache(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream goes down
+	mir.upstream = fmt.Sprintf("git://localhost:%d/", deadPort)
+	repo.upstreamURL = mir.upstream + repo.path
+	repo.upstreamHost = upstreamHostOf(mir.upstream)
+	if err := runCommand("git", "--git-dir", repo.localDir, "remote", "set-url", "origin", repo.upstreamURL); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(s.URL + "/foo/stale.git/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d for stale mirror", resp.StatusCode)
+		}
+		if resp.Header.Get("X-Mir-Stale") == "" {
+			t.Fatal("X-Mir-Stale header not set")
+		}
+	}
+
+	// a directory which is not a mirror is never served
+	notMirror := filepath.Join(mir.basePath, "foo", "notmirror")
+	if err := os.MkdirAll(notMirror, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(notMirror, "secret"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(s.URL + "/foo/notmirror.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.Header.Get("X-Mir-Stale") != "" {
+		t.Fatalf("got status %d for a directory which is not a mirror", resp.StatusCode)
+	}
+
+	resp, err = http.Get(s.URL + "/foo/nonexistent.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d while circuit is open", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("Retry-After header not set")
+	}
+}
+
+func TestMir_MissingRepositories(t *testing.T) {
+	if _, err := gitDaemon.addRepo("foo/found"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, s := newTestServer(t, func(mir *server) {
+		mir.upstreams.failureThreshold = 3
+		mir.upstreams.maxBackoff = time.Minute
+	})
+
+	// repositories not found upstream do not open the circuit
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(fmt.Sprintf("%s/foo/missing%d.git/info/refs?service=git-upload-pack", s.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("got status %d for a missing repository", resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/foo/found.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d after missing repositories", resp.StatusCode)
+	}
+}
+
+func TestMir_Offline(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	upstreamRepo, err := gitDaemon.addRepo("foo/offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCommand("git", "--git-dir", string(upstreamRepo), "branch", "wip", "master"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundleFile := filepath.Join(wd, "offline.bundle")
+	if err := runCommand("git", "--git-dir", string(upstreamRepo), "bundle", "create", bundleFile, "--all"); err != nil {
+		t.Fatal(err)
+	}
+
+	tarball := filepath.Join(wd, "offline.tar.gz")
+	if err := runCommand("tar", "-czf", tarball, "-C", filepath.Dir(string(upstreamRepo)), filepath.Base(string(upstreamRepo))); err != nil {
+		t.Fatal(err)
+	}
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.upstream = ""
+		mir.offline = true
+		mir.config = &config{
+			Repositories: []repositoryConfig{
+				{Path: "offline/filtered", ExcludeRefs: []string{"refs/heads/wip"}},
+				{Path: "offline/stored", Store: "offline"},
+			},
+		}
+	})
+
+	if err := mir.importMirror("offline/bundled", bundleFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// refs are filtered as if mirrored from upstream
+	if err := mir.importMirror("offline/filtered", bundleFile); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommandOutput("git", "--git-dir", mirRepository(t, mir, "offline/filtered").localDir, "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := strings.Fields(out.String()); len(refs) != 1 || refs[0] != "refs/heads/master" {
+		t.Fatalf("got refs %v imported with refs/heads/wip excluded", refs)
+	}
+
+	// namespaces of shared stores cannot be imported
+	if err := mir.importMirror("offline/stored", bundleFile); err == nil {
+		t.Fatal("expected import into a shared store to fail")
+	}
+	if _, err := os.Stat(mir.storeDir("offline")); !os.IsNotExist(err) {
+		t.Fatalf("shared store created on import: %v", err)
+	}
+	if err := mir.importMirror("offline/tarball", tarball); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"offline/bundled", "offline/tarball"} {
+		if _, err := os.Stat(filepath.Join(mirRepository(t, mir, path).localDir, "info", "refs")); err != nil {
+			t.Errorf("%s: info/refs not written on import: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"offline/bundled", "offline/tarball"} {
+		err := runCommand("git", "clone", "--quiet", s.URL+"/"+path+".git", filepath.Join(wd, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/foo/offline.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d for repository not on disk", resp.StatusCode)
+	}
+}
+
+func TestMir_Cluster(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	var mirs [2]*server
+	var servers [2]*httptest.Server
+	var peers []string
+	for i := range mirs {
+		mirs[i], servers[i] = newTestServer(t, func(mir *server) {
+			mir.refsFreshFor = 50 * time.Millisecond
+		})
+		peers = append(peers, servers[i].URL)
+	}
+
+	for i, mir := range mirs {
+		var err error
+		mir.cluster, err = newCluster(servers[i].URL, append([]string{}, peers...), 1, i == 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := gitDaemon.addRepo("foo/cluster"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range servers {
+		err := runCommand("git", "clone", "--quiet", s.URL+"/foo/cluster.git", filepath.Join(wd, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mirrored int
+	for _, mir := range mirs {
+		if mirRepository(t, mir, "foo/cluster").exists() {
+			mirrored++
+		}
+	}
+	if mirrored != 1 {
+		t.Fatalf("repository mirrored by %d peers, expected 1", mirrored)
+	}
+
+	// git:// is served only by the owner, and refused by the others
+	if _, err := gitDaemon.addRepo("foo/cluster-git"); err != nil {
+		t.Fatal(err)
+	}
+	for i, mir := range mirs {
+		owner, owns := mir.cluster.owner("foo/cluster-git")
+		line := gitDaemonFirstLine(t, serveTestGitDaemon(t, mir), "/foo/cluster-git.git")
+		if owns {
+			if strings.HasPrefix(line, "ERR ") {
+				t.Errorf("peer %d refused git:// for its own repository: %q", i, line)
+			}
+			continue
+		}
+		if line != "ERR repository is served by "+owner+"\n" {
+			t.Errorf("peer %d served git:// for repository of %s: %q", i, owner, line)
+		}
+		if mirRepository(t, mir, "foo/cluster-git").exists() {
+			t.Errorf("peer %d mirrored repository of %s over git://", i, owner)
+		}
+	}
+}
+
+func TestMir_FillFromPeer(t *testing.T) {
+	upstreamRepo, err := gitDaemon.addRepo("foo/fill")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := &config{
+		Repositories: []repositoryConfig{
+			{Path: "foo/fill-rewritten", RewriteRefs: map[string]string{"refs/heads/": "refs/heads/upstream/"}},
+		},
+	}
+	mir1, s1 := newTestServer(t, func(mir *server) {
+		// trusts the fill requests of mir2, which come from loopback
+		mir.fillPeers = []string{"http://127.0.0.1:1"}
+		mir.config = rewritten
+	})
+	mir2 := newTestMir(t, func(mir *server) {
+		mir.fillPeers = []string{s1.URL}
+		mir.config = rewritten
+	})
+
+	// the peer does not have the repository yet
+	filled := peerFilled.Value()
+	repo2 := mirRepository(t, mir2, "foo/fill")
+	if err := mir2.synchronizeCache(repo2); err != nil {
+		t.Fatal(err)
+	}
+	if peerFilled.Value() != filled {
+		t.Fatal("filled from peer without the repository")
+	}
+	if mirRepository(t, mir1, "foo/fill").exists() {
+		t.Fatal("peer synchronized on fill request")
+	}
+
+	if err := mir1.synchronizeCache(mirRepository(t, mir1, "foo/fill")); err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream advances after the peer mirrored it
+	if err := upstreamRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// mirror again, now that the peer has the repository
+	if err := os.RemoveAll(repo2.localDir); err != nil {
+		t.Fatal(err)
+	}
+	repo2.lastSynchronized = time.Time{}
+	if err := mir2.synchronizeCache(repo2); err != nil {
+		t.Fatal(err)
+	}
+
+	if peerFilled.Value() != filled+1 {
+		t.Fatal("not filled from peer")
+	}
+
+	upstreamHead, err := upstreamRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommandOutput("git", "--git-dir", repo2.localDir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirrorHead := strings.TrimSpace(out.String()); upstreamHead != mirrorHead {
+		t.Fatalf("mirror not updated from upstream after filling: %s != %s", mirrorHead, upstreamHead)
+	}
+
+	// peers fill with the refs as mirrored, not as rewritten for clients
+	if _, err := gitDaemon.addRepo("foo/fill-rewritten"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mir1.synchronizeCache(mirRepository(t, mir1, "foo/fill-rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	repo2 = mirRepository(t, mir2, "foo/fill-rewritten")
+	if err := mir2.synchronizeCache(repo2); err != nil {
+		t.Fatal(err)
+	}
+	if peerFilled.Value() != filled+2 {
+		t.Fatal("not filled from peer")
+	}
+	out, err = runCommandOutput("git", "--git-dir", repo2.localDir, "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := out.String(); strings.Contains(refs, "refs/heads/upstream/") || !strings.Contains(refs, "refs/heads/") {
+		t.Errorf("filled with rewritten refs: %s", refs)
+	}
+	if err := runCommand("git", "--git-dir", repo2.localDir, "rev-parse", "--verify", "HEAD"); err != nil {
+		t.Errorf("HEAD broken after filling: %s", err)
+	}
+}
+
+func TestMir_WantNotFound(t *testing.T) {
+	upstreamRepo, err := gitDaemon.addRepo("foo/want")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refs are fresh enough not to be synchronized by time
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.refsFreshFor = time.Hour
+		mir.minRefsFreshFor = time.Hour
+	})
+
+	if err := runCommand("git", "ls-remote", s.URL+"/foo/want.git"); err != nil {
+		t.Fatal(err)
+	}
+
+	// advertised by another server
+	if err := upstreamRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+	headRev, err := upstreamRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line := uploadPackWant(t, s.URL+"/foo/want.git", headRev); line != "NAK\n" {
+		t.Fatalf("got %q", line)
+	}
+
+	// synchronized only once within the minimum freshness
+	if err := upstreamRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+	headRev, err = upstreamRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line := uploadPackWant(t, s.URL+"/foo/want.git", headRev); line == "NAK\n" {
+		t.Fatalf("got %q", line)
+	}
+	if err := runCommand("git", "--git-dir", mirRepository(t, mir, "foo/want").localDir, "cat-file", "-e", headRev); err == nil {
+		t.Fatal("synchronized again within the minimum freshness")
+	}
+}
+
+func TestMir_NoopSync(t *testing.T) {
+	upstreamRepo, err := gitDaemon.addRepo("foo/noop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand("git", "--git-dir", string(upstreamRepo), "branch", "topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	// refs are synchronized on every request
+	_, s := newTestServer(t, nil)
+
+	// protocol v0 to synchronize once per ls-remote
+	lsRemote := func() string {
+		out, err := runCommandOutput("git", "-c", "protocol.version=0", "ls-remote", s.URL+"/foo/noop.git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	lsRemote()
+
+	noop := syncNoop.Value()
+	lsRemote()
+	if got := syncNoop.Value() - noop; got != 1 {
+		t.Errorf("syncNoop increased by %d", got)
+	}
+
+	if err := upstreamRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand("git", "--git-dir", string(upstreamRepo), "branch", "-D", "topic"); err != nil {
+		t.Fatal(err)
+	}
+	headRev, err := upstreamRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noop = syncNoop.Value()
+	refs := lsRemote()
+	if got := syncNoop.Value() - noop; got != 0 {
+		t.Errorf("syncNoop increased by %d", got)
+	}
+	if !strings.Contains(refs, headRev+"\tHEAD") {
+		t.Errorf("new commit not fetched: %s", refs)
+	}
+	if strings.Contains(refs, "refs/heads/topic") {
+		t.Errorf("removed branch not deleted: %s", refs)
+	}
+}
+
+func TestMir_Freshness(t *testing.T) {
+	pinned := freshness(pinnedFreshness)
+	_, s := newTestServer(t, func(mir *server) {
+		mir.refsFreshFor = time.Hour
+		mir.config = &config{
+			Repositories: []repositoryConfig{
+				{Path: "fresh/pinned", RefsFreshFor: &pinned, MinRefsFreshFor: &pinned},
+			},
+		}
+	})
+
+	for _, test := range []struct {
+		path    string
+		fetched bool
+	}{
+		{"fresh/requested", true},
+		{"fresh/pinned", false},
+	} {
+		upstreamRepo, err := gitDaemon.addRepo(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := runCommand("git", "ls-remote", s.URL+"/"+test.path+".git"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := upstreamRepo.addNewCommit(); err != nil {
+			t.Fatal(err)
+		}
+		headRev, err := upstreamRepo.head()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := runCommandOutput("git", "ls-remote", s.URL+"/"+test.path+".git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out.String(), headRev) {
+			t.Errorf("%s: synchronized within freshness", test.path)
+		}
+
+		out, err = runCommandOutput("git", "-c", "http.extraHeader="+freshnessHeader+": 0", "ls-remote", s.URL+"/"+test.path+".git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(out.String(), headRev); got != test.fetched {
+			t.Errorf("%s: fetched = %v on fresher refs requested", test.path, got)
+		}
+	}
+}
+
+func TestMir_RefFilter(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.config = &config{
+			Repositories: []repositoryConfig{
+				{Path: "refs/filtered", ExcludeRefs: []string{"refs/pull/*"}},
+				{Path: "refs/rewritten", RewriteRefs: map[string]string{"refs/heads/": "refs/heads/upstream/"}},
+			},
+		}
+		mir.dumbHTTP = true
+		mir.bundleInterval = time.Hour
+		mir.bundleHotClones = 1
+	})
+
+	for _, path := range []string{"refs/filtered", "refs/rewritten"} {
+		upstreamRepo, err := gitDaemon.addRepo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runCommand("git", "--git-dir", string(upstreamRepo), "update-ref", "refs/pull/1/head", "HEAD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := runCommandOutput("git", "ls-remote", s.URL+"/refs/filtered.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := out.String(); strings.Contains(refs, "refs/pull/") || !strings.Contains(refs, "refs/heads/") {
+		t.Errorf("got refs: %s", refs)
+	}
+
+	out, err = runCommandOutput("git", "--git-dir", mirRepository(t, mir, "refs/filtered").localDir, "for-each-ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := out.String(); strings.Contains(refs, "refs/pull/") {
+		t.Errorf("excluded refs mirrored: %s", refs)
+	}
+
+	if err := runCommand("git", "clone", s.URL+"/refs/rewritten.git", filepath.Join(wd, "rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runCommandOutput("git", "-C", filepath.Join(wd, "rewritten"), "for-each-ref", "--format=%(refname)", "refs/remotes/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range strings.Fields(out.String()) {
+		if ref != "refs/remotes/origin/HEAD" && !strings.HasPrefix(ref, "refs/remotes/origin/upstream/") {
+			t.Errorf("got ref %s", ref)
+		}
+	}
+	if !strings.Contains(out.String(), "refs/remotes/origin/upstream/") {
+		t.Errorf("rewritten refs not fetched: %s", out.String())
+	}
+
+	// the transports which cannot filter or rewrite refs refuse the repositories
+	for _, path := range []string{"refs/filtered", "refs/rewritten"} {
+		for _, file := range []string{"info/refs", "HEAD", "objects/info/packs"} {
+			resp, err := http.Get(s.URL + "/" + path + ".git/" + file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: got status %d for dumb HTTP %s", path, resp.StatusCode, file)
+			}
+		}
+	}
+	if line := gitDaemonFirstLine(t, serveTestGitDaemon(t, mir), "/refs/rewritten.git"); !strings.HasPrefix(line, "ERR ") {
+		t.Errorf("got %q over git:// for repository rewriting refs", line)
+	}
+
+	// nor are bundles built or served, as they have the refs as mirrored
+	repo := mirRepository(t, mir, "refs/rewritten")
+	mir.scheduleBundle(repo)
+	if atomic.LoadInt32(&repo.bundling) != 0 || repo.hasBundle() {
+		t.Error("bundle scheduled for repository rewriting refs")
+	}
+	if err := mir.buildBundle(repo); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(s.URL + "/refs/rewritten.git/clone.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for bundle of repository rewriting refs", resp.StatusCode)
+	}
+}
+
+func TestMir_Namespace(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.config = &config{
+			Repositories: []repositoryConfig{
+				{Path: "ns/*", Store: "ns"},
+			},
+		}
+	})
+
+	heads := map[string]string{}
+	for _, path := range []string{"ns/a", "ns/b"} {
+		upstreamRepo, err := gitDaemon.addRepo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		heads[path], err = upstreamRepo.head()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"ns/a", "ns/b"} {
+		dir := filepath.Join(wd, path)
+		if err := runCommand("git", "clone", s.URL+"/"+path+".git", dir); err != nil {
+			t.Fatal(err)
+		}
+		out, err := runCommandOutput("git", "-C", dir, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(out.String()); got != heads[path] {
+			t.Errorf("%s: got HEAD %s, expected %s", path, got, heads[path])
+		}
+
+		out, err = runCommandOutput("git", "ls-remote", s.URL+"/"+path+".git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for other, head := range heads {
+			if other != path && strings.Contains(out.String(), head) {
+				t.Errorf("%s: refs of %s advertised: %s", path, other, out.String())
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(mir.basePath, "ns")); !os.IsNotExist(err) {
+		t.Errorf("mirror created out of the store: %v", err)
+	}
+	out, err := runCommandOutput("git", "--git-dir", filepath.Join(mir.basePath, storesDirName, "ns"), "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range strings.Fields(out.String()) {
+		if !strings.HasPrefix(ref, "refs/namespaces/ns%2Fa/") && !strings.HasPrefix(ref, "refs/namespaces/ns%2Fb/") {
+			t.Errorf("got ref %s in the store", ref)
+		}
+	}
+
+	// the store is checked once for the namespaces, along with other mirrors
+	mir.fsckInterval = time.Hour
+	if _, err := gitDaemon.addRepo("foo/nsfsck"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mir.synchronizeCache(mirRepository(t, mir, "foo/nsfsck")); err != nil {
+		t.Fatal(err)
+	}
+	due := mir.fsckDueRepositories()
+	if len(due) != 2 {
+		t.Fatalf("got %d mirrors due for fsck, expected 2", len(due))
+	}
+	for _, repo := range due {
+		if err := mir.checkIntegrity(repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if due := mir.fsckDueRepositories(); len(due) != 0 {
+		t.Errorf("got %d mirrors due for fsck after checked", len(due))
+	}
+}
+
+func TestMir_Fork(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	baseRepo, err := gitDaemon.addRepo("fork/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forkRepo := upstreamRepo(filepath.Join(gitDaemon.basePath, "fork/fork.git"))
+	if err := runCommand("git", "clone", "--bare", string(baseRepo), string(forkRepo)); err != nil {
+		t.Fatal(err)
+	}
+	if err := forkRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the base matches the same pattern as the fork
+	configFile := filepath.Join(tempDir(t, "mir-test-config"), "config.json")
+	if err := ioutil.WriteFile(configFile, []byte(`{"repositories":[{"path":"fork/*","forkOf":"fork/base.git"}]}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	forkConfig, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.config = forkConfig
+		mir.dumbHTTP = true
+	})
+	if !mir.config.isForkBase("fork/base") {
+		t.Error("base not recognized as base of forks")
+	}
+
+	if err := runCommand("git", "clone", s.URL+"/fork/fork.git", filepath.Join(wd, "fork")); err != nil {
+		t.Fatal(err)
+	}
+
+	base, fork := mirRepository(t, mir, "fork/base"), mirRepository(t, mir, "fork/fork")
+	if !base.exists() {
+		t.Fatal("base not mirrored")
+	}
+
+	alternates, err := ioutil.ReadFile(filepath.Join(fork.localDir, "objects/info/alternates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDir, _ := filepath.Abs(base.localDir)
+	if got := strings.TrimSpace(string(alternates)); got != filepath.Join(baseDir, "objects") {
+		t.Errorf("got alternates %q", got)
+	}
+
+	// objects only in the base are not copied into the fork
+	baseRev, err := baseRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []*repository{base, fork} {
+		if err := mir.runMaintenance(repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fork.localDir, "objects", baseRev[:2], baseRev[2:])); err == nil {
+		t.Errorf("base object %s copied into fork", baseRev)
+	}
+	idxs, err := filepath.Glob(filepath.Join(fork.localDir, "objects/pack/*.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range idxs {
+		f, err := os.Open(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("git", "show-index")
+		cmd.Stdin = f
+		out, err := cmd.Output()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(out), baseRev) {
+			t.Errorf("base object %s packed in fork", baseRev)
+		}
+	}
+
+	if err := runCommand("git", "--git-dir", fork.localDir, "fsck", "--connectivity-only"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand("git", "clone", s.URL+"/fork/fork.git", filepath.Join(wd, "fork2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the local path of the base is not exposed over dumb HTTP
+	for _, path := range []string{"fork/fork.git/info/refs", "fork/fork.git/objects/info/alternates", "fork/base.git/objects/info/alternates"} {
+		resp, err := http.Get(s.URL + "/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("got status %d for dumb HTTP %s", resp.StatusCode, path)
+		}
+	}
+}
+
+func TestMir_PackCacheInvalidation(t *testing.T) {
+	upstreamRepo, err := gitDaemon.addRepo("foo/invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headRev, err := upstreamRepo.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refs are synchronized on every request
+	_, s := newTestServer(t, func(mir *server) {
+		mir.packCache = newPackCache(64<<20, 0, packCacheLRU)
+	})
+
+	uploadPack := func() {
+		if line := uploadPackWant(t, s.URL+"/foo/invalidation.git", headRev); line != "NAK\n" {
+			t.Fatalf("got %q", line)
+		}
+	}
+
+	hit, invalidated := packCacheHit.Value(), packCacheInvalidated.Value()
+	uploadPack()
+	uploadPack()
+	if got := packCacheHit.Value() - hit; got != 1 {
+		t.Errorf("packCacheHit increased by %d", got)
+	}
+
+	if err := upstreamRepo.addNewCommit(); err != nil {
+		t.Fatal(err)
+	}
+
+	hit = packCacheHit.Value()
+	uploadPack()
+	if got := packCacheHit.Value() - hit; got != 0 {
+		t.Errorf("packCacheHit increased by %d after refs changed", got)
+	}
+	if got := packCacheInvalidated.Value() - invalidated; got != 1 {
+		t.Errorf("packCacheInvalidated increased by %d", got)
+	}
+
+	uploadPack()
+	if got := packCacheHit.Value() - hit; got != 1 {
+		t.Errorf("packCacheHit increased by %d", got)
+	}
+}
+
+func TestMir_DumbHTTP(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	for _, path := range []string{"foo/dumb", "foo/dumb-existing"} {
+		if _, err := gitDaemon.addRepo(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mir := newTestMir(t, nil)
+
+	// mirrored before serving dumb HTTP, and not changed since
+	if err := mir.synchronizeCache(mirRepository(t, mir, "foo/dumb-existing")); err != nil {
+		t.Fatal(err)
+	}
+	mir.dumbHTTP = true
+
+	s := httptest.NewServer(mir)
+	t.Cleanup(s.Close)
+
+	for _, path := range []string{"foo/dumb", "foo/dumb-existing"} {
+		dir := filepath.Join(wd, path)
+		cmd := exec.Command("git", "clone", "--quiet", s.URL+"/"+path+".git", dir)
+		cmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s: %s", path, err, out)
+		}
+
+		if err := runCommand("git", "-C", dir, "log", "-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMir_PathTraversal(t *testing.T) {
+	mir, s := newTestServer(t, func(mir *server) {
+		mir.dumbHTTP = true
+	})
+	addr := serveTestGitDaemon(t, mir)
+
+	for _, path := range []string{
+		"/../victim/info/refs?service=git-upload-pack",
+		"/foo/../../victim.git/info/refs?service=git-upload-pack",
+		"/./foo/bar.git/git-upload-pack",
+		"/foo//bar.git/info/refs?service=git-upload-pack",
+		"/.stores/ns/info/refs?service=git-upload-pack",
+		"/.quarantine/1/foo/bar/HEAD",
+	} {
+		method := "GET"
+		if strings.HasSuffix(path, "/git-upload-pack") {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", path, resp.StatusCode)
+		}
+
+		if line := gitDaemonFirstLine(t, addr, strings.SplitN(path, "?", 2)[0]); !strings.HasPrefix(line, "ERR ") {
+			t.Errorf("git://%s: got %q", path, line)
+		}
+	}
+
+	if repos := mir.repositories(); len(repos) != 0 {
+		t.Errorf("got %d repositories registered", len(repos))
+	}
+
+	// never removes directories out of base path
+	victim := tempDir(t, "mir-test-victim")
+	repo := &repository{RWMutex: &sync.RWMutex{}, path: "victim", localDir: victim}
+	if evicted, err := mir.evict(repo, time.Now()); evicted || err == nil {
+		t.Error("evicted a mirror out of base path")
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("directory out of base path removed: %v", err)
+	}
+}
+
+func TestMir_GitDaemon(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	if _, err := gitDaemon.addRepo("foo/gitd"); err != nil {
+		t.Fatal(err)
+	}
+
+	mir := newTestMir(t, func(mir *server) {
+		mir.refsFreshFor = 50 * time.Millisecond
+	})
+	addr := serveTestGitDaemon(t, mir)
+
+	for _, version := range []string{"0", "2"} {
+		err := runCommand("git", "-c", "protocol.version="+version, "clone", "--quiet", "git://"+addr+"/foo/gitd.git", filepath.Join(wd, version))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := runCommand("git", "ls-remote", "git://"+addr+"/foo/nonexistent.git")
+	if err == nil || !strings.Contains(err.Error(), "remote error") {
+		t.Fatalf("expected remote error, got %v", err)
+	}
+
+	// rate limited the same way as HTTP
+	limited := newTestMir(t, func(mir *server) {
+		mir.rateLimitKeys = []string{"ip"}
+		mir.uploadPackLimiter.limit = rateLimit{rate: 1.0 / 60, burst: 1}
+	})
+	limitedAddr := serveTestGitDaemon(t, limited)
+	if err := runCommand("git", "ls-remote", "git://"+limitedAddr+"/foo/gitd.git"); err != nil {
+		t.Fatal(err)
+	}
+	err = runCommand("git", "ls-remote", "git://"+limitedAddr+"/foo/gitd.git")
+	if err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Fatalf("expected git:// to be rate limited, got %v", err)
+	}
+}
+
+func TestMir_SSH(t *testing.T) {
+	wd := tempDir(t, "mir-test-worktree")
+
+	if _, err := gitDaemon.addRepo("foo/ssh"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"host", "alice", "bob", "mallory"} {
+		err := runCommand("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(wd, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var authorized []byte
+	for _, name := range []string{"alice", "bob"} {
+		pub, err := ioutil.ReadFile(filepath.Join(wd, name+".pub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorized = append(authorized, pub...)
+	}
+	authorizedKeysFile := filepath.Join(wd, "authorized_keys")
+	if err := ioutil.WriteFile(authorizedKeysFile, authorized, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := newAuthorizedKeys(authorizedKeysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newSSHServerConfig(filepath.Join(wd, "host"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rate limited by the key rather than the address, shared by the clients
+	mir := newTestMir(t, func(mir *server) {
+		mir.rateLimitKeys = []string{"identity"}
+		mir.uploadPackLimiter.limit = rateLimit{rate: 1.0 / 60, burst: 1}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go mir.serveSSH(l, config)
+
+	gitSSH := func(key string, args ...string) error {
+		sshCommand := fmt.Sprintf("ssh -i %s -p %d -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o IdentitiesOnly=yes -o BatchMode=yes", filepath.Join(wd, key), l.Addr().(*net.TCPAddr).Port)
+		return runCommand("git", append([]string{"-c", "core.sshCommand=" + sshCommand}, args...)...)
+	}
+
+	for i, version := range []string{"0", "2"} {
+		key := []string{"alice", "bob"}[i]
+		err := gitSSH(key, "-c", "protocol.version="+version, "clone", "--quiet", "git@127.0.0.1:foo/ssh.git", filepath.Join(wd, "clone"+version))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = gitSSH("alice", "ls-remote", "git@127.0.0.1:foo/ssh.git")
+	if err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Fatalf("expected SSH to be rate limited, got %v", err)
+	}
+
+	if err := gitSSH("mallory", "ls-remote", "git@127.0.0.1:foo/ssh.git"); err == nil {
+		t.Fatal("expected unauthorized key to be refused")
+	}
+
+	// keys are reloaded
+	mallory, err := ioutil.ReadFile(filepath.Join(wd, "mallory.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(authorizedKeysFile, mallory, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(authorizedKeysFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	keys.mu.Lock()
+	keys.checkedAt = time.Time{}
+	keys.mu.Unlock()
+
+	if err := gitSSH("mallory", "ls-remote", "git@127.0.0.1:foo/ssh.git"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitSSH("bob", "ls-remote", "git@127.0.0.1:foo/ssh.git"); err == nil {
+		t.Fatal("expected removed key to be refused")
+	}
+}
+
 func emptyPort() (int, error) {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
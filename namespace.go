@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storesDirName is the directory under base path where the shared stores of
+// repositories served as git namespaces are.
+const storesDirName = ".stores"
+
+// namespaceOf returns the git namespace of the repository at repoPath
+// in a shared store. Escaping slashes keeps namespaces from nesting.
+func namespaceOf(repoPath string) string {
+	return url.PathEscape(repoPath)
+}
+
+// storeDir returns the directory of the shared store named store.
+func (s *server) storeDir(store string) string {
+	return filepath.Join(append([]string{s.basePath, storesDirName}, strings.Split(store, "/")...)...)
+}
+
+// storeLock returns the lock shared by the repositories in store.
+// Caller must hold s.repos.
+func (s *server) storeLock(store string) *sync.RWMutex {
+	if s.repos.stores == nil {
+		s.repos.stores = map[string]*sync.RWMutex{}
+	}
+
+	mu, ok := s.repos.stores[store]
+	if !ok {
+		mu = &sync.RWMutex{}
+		s.repos.stores[store] = mu
+	}
+	return mu
+}
+
+// refName returns the name in the mirror of the ref name in upstream,
+// prefixed by the namespace of repo if any.
+func (repo *repository) refName(name string) string {
+	if repo.namespace == "" {
+		return name
+	}
+	return "refs/namespaces/" + repo.namespace + "/" + name
+}
+
+// remote returns the remote to synchronize repo from. A shared store
+// has no remote configured, as its repositories have their own upstreams.
+func (repo *repository) remote() string {
+	if repo.namespace == "" {
+		return "origin"
+	}
+	return repo.upstreamURL
+}
+
+// uploadPackEnv returns the environment of git upload-pack serving repo
+// with the protocol requested by the client, or nil for the default.
+func (repo *repository) uploadPackEnv(protocol string) []string {
+	var env []string
+	if protocol != "" {
+		env = append(env, "GIT_PROTOCOL="+protocol)
+	}
+	if repo.namespace != "" {
+		env = append(env, "GIT_NAMESPACE="+repo.namespace)
+	}
+
+	if env == nil {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// remoteHead returns the branch HEAD of remote points to, running git in dir.
+// It returns an empty string if HEAD is detached or missing.
+func (repo *repository) remoteHead(dir, remote string) (string, error) {
+	var out bytes.Buffer
+	gitLsRemote := repo.upstreamCommand("--git-dir=.", "ls-remote", "--symref", remote, "HEAD")
+	gitLsRemote.cmd.Dir = dir
+	gitLsRemote.cmd.Stdout = &out
+	if err := gitLsRemote.run(); err != nil {
+		return "", err
+	}
+
+	line := strings.SplitN(out.String(), "\n", 2)[0]
+	if !strings.HasPrefix(line, "ref: ") || !strings.HasSuffix(line, "\tHEAD") {
+		return "", nil
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(line, "ref: "), "\tHEAD"), nil
+}
+
+// initStore creates an empty shared store in the empty directory dir.
+func (repo *repository) initStore(dir string) error {
+	gitInit := repo.gitCommand("init", "--bare", ".")
+	gitInit.cmd.Dir = dir
+	return gitInit.run()
+}
+
+// synchronizeNamespace fetches the refs of repo into its namespace in the
+// shared store, creating the store if absent.
+// Caller must hold the write lock of repo.
+func (s *server) synchronizeNamespace(repo *repository) error {
+	if !repo.storeExists() {
+		tmpDir, err := s.cloneTemp(repo)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmpDir, repo.localDir); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+
+	created := !repo.exists()
+
+	changed, err := s.updateMirror(repo)
+	if err != nil {
+		return err
+	}
+
+	// the namespace exists once its HEAD is set, as "git clone" would do
+	if created {
+		head, err := repo.remoteHead(repo.localDir, repo.remote())
+		if err != nil {
+			return err
+		}
+		if head == "" || !s.config.repository(repo.path).includesRef(head) {
+			head = "refs/heads/master"
+		}
+
+		gitSymbolicRef := repo.gitCommand("symbolic-ref", repo.refName("HEAD"), repo.refName(head))
+		if err := gitSymbolicRef.run(); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&repo.maintainedAt, time.Now().UnixNano())
+	}
+
+	repo.lastSynchronized = time.Now()
+	if !changed {
+		return nil
+	}
+
+	s.updateServerInfo(repo)
+	if n := atomic.AddInt32(&repo.syncsSinceMaintenance, 1); s.maintenanceAfterSyncs > 0 && int(n) >= s.maintenanceAfterSyncs {
+		s.scheduleMaintenance(repo)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	packCacheBytes    = expvar.NewInt("packCacheBytes")
+	packCacheEvicted  = expvar.NewInt("packCacheEvicted")
+	packCacheTooLarge = expvar.NewInt("packCacheTooLarge")
+)
+
+// packCachePolicy is a flag.Value for the eviction policy of packCache.
+type packCachePolicy string
+
+const (
+	// packCacheLRU evicts the least recently used entries.
+	packCacheLRU packCachePolicy = "lru"
+	// packCacheCost evicts the entries cheapest to generate again per byte
+	// and not used recently, by GreedyDual-Size.
+	packCacheCost packCachePolicy = "cost"
+)
+
+func (p *packCachePolicy) Set(s string) error {
+	switch packCachePolicy(s) {
+	case packCacheLRU, packCacheCost:
+		*p = packCachePolicy(s)
+		return nil
+	}
+	return fmt.Errorf("invalid pack cache policy: %q", s)
+}
+
+func (p *packCachePolicy) String() string {
+	return string(*p)
+}
+
+// packCache caches the responses of git-upload-pack up to maxBytes in total.
+// Each entry is tagged with the ref state of the mirror it is generated from,
+// and is invalid once the refs change. A nil *packCache caches nothing.
+type packCache struct {
+	sync.Mutex
+
+	maxBytes      int64
+	maxEntryBytes int64
+	policy        packCachePolicy
+
+	bytes int64
+	// ll has the entries, the most recently used first
+	ll      *list.List
+	entries map[string]*list.Element
+	// keys are the keys of the entries by repository path,
+	// to invalidate them all when the refs of the repository change
+	keys map[string]map[string]struct{}
+	// inflation is raised to the priority of each evicted entry
+	// by the cost policy, so that entries not used recently age
+	inflation float64
+}
+
+type packCacheEntry struct {
+	key      string
+	repoPath string
+	refState string
+	data     []byte
+	// cost is the time it took to generate data
+	cost     time.Duration
+	priority float64
+}
+
+// newPackCache creates a packCache of maxBytes, which does not cache
+// responses larger than maxEntryBytes unless it is zero.
+func newPackCache(maxBytes, maxEntryBytes int64, policy packCachePolicy) *packCache {
+	return &packCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		policy:        policy,
+		ll:            list.New(),
+		entries:       map[string]*list.Element{},
+		keys:          map[string]map[string]struct{}{},
+	}
+}
+
+func (c *packCache) key(repo *repository, clientRequest []byte) string {
+	reqDigest := sha1.Sum(clientRequest)
+	return repo.path + "\000" + string(reqDigest[:])
+}
+
+// touch marks e as used now.
+// Caller must hold c.
+func (c *packCache) touch(e *list.Element) {
+	c.ll.MoveToFront(e)
+
+	entry := e.Value.(*packCacheEntry)
+	entry.priority = c.inflation + entry.cost.Seconds()/float64(len(entry.data)+1)
+}
+
+// remove removes e from c.
+// Caller must hold c.
+func (c *packCache) remove(e *list.Element) {
+	entry := e.Value.(*packCacheEntry)
+
+	c.ll.Remove(e)
+	delete(c.entries, entry.key)
+	delete(c.keys[entry.repoPath], entry.key)
+	if len(c.keys[entry.repoPath]) == 0 {
+		delete(c.keys, entry.repoPath)
+	}
+
+	c.bytes -= int64(len(entry.data))
+	packCacheBytes.Add(-int64(len(entry.data)))
+}
+
+// victim returns the entry to evict by c.policy.
+// Caller must hold c.
+func (c *packCache) victim() *list.Element {
+	if c.policy != packCacheCost {
+		return c.ll.Back()
+	}
+
+	var victim *list.Element
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		if victim == nil || e.Value.(*packCacheEntry).priority < victim.Value.(*packCacheEntry).priority {
+			victim = e
+		}
+	}
+	if victim != nil {
+		c.inflation = victim.Value.(*packCacheEntry).priority
+	}
+	return victim
+}
+
+// Get returns the cached response to clientRequest for repo, or nil.
+// Caller must hold the read lock of repo.
+func (c *packCache) Get(repo *repository, clientRequest []byte) []byte {
+	if c == nil {
+		return nil
+	}
+
+	// may run git, which must not block other repositories on c
+	refState := repo.currentRefState()
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[c.key(repo, clientRequest)]
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*packCacheEntry)
+	if entry.refState != refState {
+		packCacheInvalidated.Add(1)
+		c.remove(e)
+		return nil
+	}
+
+	c.touch(e)
+	return entry.data
+}
+
+// Add caches the response data to clientRequest for repo, which took cost
+// to generate, evicting other entries to keep c within c.maxBytes.
+// Caller must hold the read lock of repo.
+func (c *packCache) Add(repo *repository, clientRequest []byte, data []byte, cost time.Duration) {
+	if c == nil {
+		return
+	}
+
+	size := int64(len(data))
+	if size > c.maxBytes || c.maxEntryBytes > 0 && size > c.maxEntryBytes {
+		packCacheTooLarge.Add(1)
+		return
+	}
+
+	refState := repo.currentRefState()
+	if refState == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	key := c.key(repo, clientRequest)
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	for c.bytes+size > c.maxBytes {
+		e := c.victim()
+		if e == nil {
+			break
+		}
+		c.remove(e)
+		packCacheEvicted.Add(1)
+	}
+
+	entry := &packCacheEntry{
+		key:      key,
+		repoPath: repo.path,
+		refState: refState,
+		data:     data,
+		cost:     cost,
+	}
+	e := c.ll.PushFront(entry)
+	c.touch(e)
+	c.entries[key] = e
+	if c.keys[repo.path] == nil {
+		c.keys[repo.path] = map[string]struct{}{}
+	}
+	c.keys[repo.path][key] = struct{}{}
+
+	c.bytes += size
+	packCacheBytes.Add(size)
+}
+
+// invalidate removes all the entries for repo and returns the number of them.
+func (c *packCache) invalidate(repo *repository) int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for key := range c.keys[repo.path] {
+		c.remove(c.entries[key])
+		n++
+	}
+	return n
+}
+
+// refsChanged is called when the refs of the mirror of repo have changed,
+// invalidating the cached responses.
+func (s *server) refsChanged(repo *repository) {
+	repo.refState.Store("")
+	if n := s.packCache.invalidate(repo); n > 0 {
+		packCacheInvalidated.Add(int64(n))
+		logger.Printf("[repo %s] Invalidated %d pack cache entries", repo.path, n)
+	}
+}
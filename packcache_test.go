@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testRepository(path, refState string) *repository {
+	repo := &repository{path: path}
+	repo.refState.Store(refState)
+	return repo
+}
+
+func TestPackCache_Bytes(t *testing.T) {
+	c := newPackCache(100, 60, packCacheLRU)
+	repo := testRepository("foo/bar", "state1")
+
+	c.Add(repo, []byte("a"), bytes.Repeat([]byte("a"), 40), time.Second)
+	c.Add(repo, []byte("b"), bytes.Repeat([]byte("b"), 40), time.Second)
+	if c.Get(repo, []byte("a")) == nil {
+		t.Fatal("a not cached")
+	}
+
+	// b is the least recently used
+	c.Add(repo, []byte("c"), bytes.Repeat([]byte("c"), 40), time.Second)
+	if c.Get(repo, []byte("b")) != nil {
+		t.Error("b not evicted")
+	}
+	if c.Get(repo, []byte("a")) == nil || c.Get(repo, []byte("c")) == nil {
+		t.Error("a or c evicted")
+	}
+	if c.bytes != 80 {
+		t.Errorf("got %d bytes", c.bytes)
+	}
+
+	// larger than maxEntryBytes
+	c.Add(repo, []byte("d"), bytes.Repeat([]byte("d"), 61), time.Second)
+	if c.Get(repo, []byte("d")) != nil {
+		t.Error("too large entry cached")
+	}
+	if c.bytes != 80 {
+		t.Errorf("got %d bytes", c.bytes)
+	}
+}
+
+func TestPackCache_Cost(t *testing.T) {
+	c := newPackCache(100, 0, packCacheCost)
+	repo := testRepository("foo/bar", "state1")
+
+	c.Add(repo, []byte("expensive"), bytes.Repeat([]byte("e"), 40), 10*time.Second)
+	c.Add(repo, []byte("cheap"), bytes.Repeat([]byte("c"), 40), time.Millisecond)
+	c.Get(repo, []byte("cheap"))
+
+	// the cheap one is evicted even though it is used more recently
+	c.Add(repo, []byte("new"), bytes.Repeat([]byte("n"), 40), time.Second)
+	if c.Get(repo, []byte("cheap")) != nil {
+		t.Error("cheap entry not evicted")
+	}
+	if c.Get(repo, []byte("expensive")) == nil {
+		t.Error("expensive entry evicted")
+	}
+}
+
+func TestPackCache_Invalidate(t *testing.T) {
+	c := newPackCache(100, 0, packCacheLRU)
+	repo := testRepository("foo/bar", "state1")
+	other := testRepository("foo/baz", "state1")
+
+	c.Add(repo, []byte("a"), []byte("a"), time.Second)
+	c.Add(repo, []byte("b"), []byte("b"), time.Second)
+	c.Add(other, []byte("a"), []byte("a"), time.Second)
+
+	if n := c.invalidate(repo); n != 2 {
+		t.Errorf("invalidated %d entries", n)
+	}
+	if c.Get(repo, []byte("a")) != nil {
+		t.Error("entry not invalidated")
+	}
+	if c.Get(other, []byte("a")) == nil {
+		t.Error("entry of another repository invalidated")
+	}
+
+	// entries of another ref state are invalid
+	other.refState.Store("state2")
+	if c.Get(other, []byte("a")) != nil {
+		t.Error("entry of old ref state returned")
+	}
+	if c.bytes != 0 {
+		t.Errorf("got %d bytes", c.bytes)
+	}
+
+	var nilCache *packCache
+	nilCache.Add(repo, []byte("a"), []byte("a"), time.Second)
+	if nilCache.Get(repo, []byte("a")) != nil || nilCache.invalidate(repo) != 0 {
+		t.Error("nil cache cached")
+	}
+}
@@ -34,3 +34,34 @@ func TestPktLineScanner(t *testing.T) {
 		t.Fatalf("got Scan() == true, Text() = %q", s.Text())
 	}
 }
+
+func TestPktLineScanner_V2(t *testing.T) {
+	var buf bytes.Buffer
+	s := bufio.NewScanner(&buf)
+	s.Split(splitPktLine)
+	buf.WriteString("0014command=ls-refs\n")
+	buf.WriteString("0001")
+	buf.WriteString("0009peel\n")
+	buf.WriteString("0000")
+
+	nextScan(t, s, "command=ls-refs\n")
+	nextScan(t, s, "")
+	nextScan(t, s, "peel\n")
+	nextScan(t, s, "")
+	if s.Scan() == true {
+		t.Fatalf("got Scan() == true, Text() = %q", s.Text())
+	}
+}
+
+func TestPktLineScanner_Truncated(t *testing.T) {
+	s := bufio.NewScanner(bytes.NewBufferString("0009done\n0032have 1368"))
+	s.Split(splitPktLine)
+
+	nextScan(t, s, "done\n")
+	if s.Scan() == true {
+		t.Fatalf("got Scan() == true, Text() = %q", s.Text())
+	}
+	if s.Err() == nil {
+		t.Fatal("expected error for truncated pkt-line")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimited counts throttled requests by kind ("refs" or "upload-pack").
+var rateLimited = expvar.NewMap("rateLimited")
+
+// tokenBucket allows events at rate per second on average,
+// with bursts of up to burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// available reports whether a token is available, or how long to wait for one.
+func (b *tokenBucket) available(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes a token if available, or reports how long to wait for one.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	ok, wait := b.available(now)
+	if ok {
+		b.tokens--
+	}
+	return ok, wait
+}
+
+// rateLimit is a flag.Value for rates like "10/s" or "100/m:20",
+// where the number after the colon is the burst, defaulting to the count.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+func (r *rateLimit) Set(s string) error {
+	spec := s
+	var burst float64
+	if i := strings.IndexByte(spec, ':'); i != -1 {
+		b, err := strconv.ParseFloat(spec[i+1:], 64)
+		if err != nil || b < 1 {
+			return fmt.Errorf("invalid burst: %q", s)
+		}
+		burst = b
+		spec = spec[:i]
+	}
+
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rate: %q", s)
+	}
+	count, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || count <= 0 {
+		return fmt.Errorf("invalid rate: %q", s)
+	}
+
+	var per time.Duration
+	switch parts[1] {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return fmt.Errorf("invalid rate unit: %q", s)
+	}
+
+	if burst == 0 {
+		burst = math.Max(1, count)
+	}
+
+	r.rate = count / per.Seconds()
+	r.burst = burst
+	return nil
+}
+
+func (r *rateLimit) String() string {
+	if r == nil || r.rate == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g/s:%g", r.rate, r.burst)
+}
+
+// rateLimiter keeps a token bucket per key.
+type rateLimiter struct {
+	sync.Mutex
+	limit   rateLimit
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+}
+
+// allow takes a token from the bucket for key, or reports how long to wait.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	return l.bucket(key, now).take(now)
+}
+
+// bucket returns the bucket for key. Caller must hold l.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+
+	// forget the buckets which have become full, as they are the same as new ones
+	if now.Sub(l.sweptAt) > time.Minute {
+		for k, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweptAt = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.limit.rate, l.limit.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// allowAll takes a token from the bucket for key of each of limiters only if
+// all of them have one, so that a request rejected by one does not spend the
+// others. Otherwise it returns the index of the first limiter rejecting and
+// how long to wait; the index is -1 if allowed.
+// Limiters must be given in the same order by all callers.
+func allowAll(key string, limiters ...*rateLimiter) (int, time.Duration) {
+	for _, l := range limiters {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	now := time.Now()
+
+	buckets := make([]*tokenBucket, len(limiters))
+	for i, l := range limiters {
+		buckets[i] = l.bucket(key, now)
+		if ok, wait := buckets[i].available(now); !ok {
+			return i, wait
+		}
+	}
+
+	for _, b := range buckets {
+		b.take(now)
+	}
+	return -1, 0
+}
+
+// clientIdentity returns the name of the authenticated client: the common
+// name of the TLS client certificate, which is verified by -tls-client-ca.
+// The user of basic authentication is not, as mir does not check passwords.
+func clientIdentity(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
+// rateLimitKey returns the key of a client at remoteAddr for rate limiting,
+// composed of the parts in s.rateLimitKeys: "ip", "identity" (falling back
+// to IP) or "repo".
+func (s *server) rateLimitKey(remoteAddr, identity, repoPath string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	var key []string
+	for _, k := range s.rateLimitKeys {
+		switch k {
+		case "ip":
+			key = append(key, ip)
+		case "identity":
+			if identity != "" {
+				key = append(key, "id:"+identity)
+			} else {
+				key = append(key, ip)
+			}
+		case "repo":
+			key = append(key, strings.TrimSuffix(repoPath, ".git"))
+		}
+	}
+	return strings.Join(key, "\000")
+}
+
+// throttle reports whether req is rejected by limiter, responding
+// 429 Too Many Requests. Requests proxied or filling from peers are not
+// throttled, as they have been by the peers.
+func (s *server) throttle(w http.ResponseWriter, req *http.Request, limiter *rateLimiter, kind, repoPath string) bool {
+	if limiter.limit.rate == 0 || s.isFromPeer(req) {
+		return false
+	}
+
+	key := s.rateLimitKey(req.RemoteAddr, clientIdentity(req), repoPath)
+	ok, wait := limiter.allow(key)
+	if ok {
+		return false
+	}
+
+	rateLimited.Add(kind, 1)
+	logger.Printf("[request %p] Rate limited (%s) for %q", req, kind, key)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	return true
+}
+
+// throttleNative reports whether the git:// or SSH request for repoPath from
+// the client at remoteAddr, authenticated as identity if any, is rejected by
+// any of the limiters, sending an error to the client on w.
+// Such a request both advertises refs and uploads a pack.
+func (s *server) throttleNative(w io.Writer, remoteAddr, identity, repoPath string) bool {
+	var (
+		limiters []*rateLimiter
+		kinds    []string
+	)
+	for _, l := range []struct {
+		limiter *rateLimiter
+		kind    string
+	}{
+		{&s.refsLimiter, "refs"},
+		{&s.uploadPackLimiter, "upload-pack"},
+	} {
+		if l.limiter.limit.rate != 0 {
+			limiters = append(limiters, l.limiter)
+			kinds = append(kinds, l.kind)
+		}
+	}
+	if len(limiters) == 0 {
+		return false
+	}
+
+	key := s.rateLimitKey(remoteAddr, identity, repoPath)
+	i, wait := allowAll(key, limiters...)
+	if i < 0 {
+		return false
+	}
+
+	rateLimited.Add(kinds[i], 1)
+	logger.Printf("Rate limited (%s) for %q from %s", kinds[i], key, remoteAddr)
+
+	writeErrPktLine(w, fmt.Sprintf("too many requests, retry after %ds", int(math.Ceil(wait.Seconds()))))
+	return true
+}
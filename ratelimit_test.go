@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take #%d in burst failed", i)
+		}
+	}
+
+	ok, wait := b.take(now)
+	if ok {
+		t.Fatal("take after burst succeeded")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("got wait %s", wait)
+	}
+
+	if ok, _ := b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatal("take after refill failed")
+	}
+
+	// does not exceed burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take #%d in burst failed", i)
+		}
+	}
+	if ok, _ := b.take(now); ok {
+		t.Fatal("take after burst succeeded")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	var refs, uploadPack rateLimiter
+	refs.limit = rateLimit{rate: 1.0 / 60, burst: 2}
+	uploadPack.limit = rateLimit{rate: 1.0 / 60, burst: 1}
+
+	if i, _ := allowAll("key", &refs, &uploadPack); i != -1 {
+		t.Fatalf("first request rejected by #%d", i)
+	}
+
+	// rejected by the second without spending the first
+	i, wait := allowAll("key", &refs, &uploadPack)
+	if i != 1 || wait <= 0 {
+		t.Fatalf("got (%d, %s)", i, wait)
+	}
+	if ok, _ := refs.allow("key"); !ok {
+		t.Error("token of the first limiter spent by a rejected request")
+	}
+
+	if i, _ := allowAll("other", &refs, &uploadPack); i != -1 {
+		t.Errorf("request of another key rejected by #%d", i)
+	}
+}
+
+func TestRateLimit_Set(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		rate  float64
+		burst float64
+	}{
+		{"10/s", 10, 10},
+		{"120/m", 2, 120},
+		{"60/m:5", 1, 5},
+		{"0.5/s", 0.5, 1},
+	} {
+		var r rateLimit
+		if err := r.Set(test.in); err != nil {
+			t.Errorf("Set(%q): %s", test.in, err)
+			continue
+		}
+		if r.rate != test.rate || r.burst != test.burst {
+			t.Errorf("Set(%q): got %+v", test.in, r)
+		}
+	}
+
+	for _, in := range []string{"", "10", "10/d", "-1/s", "10/s:0", "x/s"} {
+		var r rateLimit
+		if err := r.Set(in); err == nil {
+			t.Errorf("Set(%q): expected error", in)
+		}
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	mir := server{
+		basePath:      "/nonexistent",
+		offline:       true,
+		rateLimitKeys: []string{"ip", "repo"},
+	}
+	mir.refsLimiter.limit = rateLimit{rate: 1.0 / 60, burst: 1}
+
+	s := httptest.NewServer(&mir)
+	defer s.Close()
+
+	get := func(path string, header ...string) *http.Response {
+		req, err := http.NewRequest("GET", s.URL+path+"/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/foo/bar.git"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("first request throttled")
+	}
+
+	resp := get("/foo/bar.git")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("Retry-After not set")
+	}
+
+	if resp := get("/foo/baz.git"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("request for another repository throttled")
+	}
+
+	// the headers of peers are trusted only from peers,
+	// and basic authentication is not an identity
+	mir.rateLimitKeys = []string{"identity"}
+	get("/foo/qux.git")
+	for _, header := range [][]string{
+		{forwardedHeader, "http://mir1:9280"},
+		{fillHeader, "1"},
+		{"Authorization", "Basic Ym9iOg=="},
+	} {
+		if resp := get("/foo/qux.git", header...); resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("request with %s from non-peer not throttled: got status %d", header[0], resp.StatusCode)
+		}
+	}
+
+	mir.fillPeers = []string{"http://127.0.0.1:9280"}
+	mir.peerAddrs.addrs = nil
+	for _, header := range [][]string{
+		{forwardedHeader, "http://127.0.0.1:9280"},
+		{fillHeader, "1"},
+	} {
+		if resp := get("/foo/qux.git", header...); resp.StatusCode == http.StatusTooManyRequests {
+			t.Errorf("request with %s from peer throttled", header[0])
+		}
+	}
+
+	// dumb HTTP refs and clone bundles are throttled as well
+	mir.rateLimitKeys = []string{"ip", "repo"}
+	mir.dumbHTTP = true
+	mir.uploadPackLimiter.limit = rateLimit{rate: 1.0 / 60, burst: 1}
+	for _, path := range []string{"/foo/dumb.git/info/refs", "/foo/dumb.git/HEAD", "/foo/bundled.git/clone.bundle"} {
+		var resp *http.Response
+		for i := 0; i < 2; i++ {
+			var err error
+			resp, err = http.Get(s.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s: got status %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// validateRefPattern checks that pattern is a full ref name
+// or a prefix of ref names ending with "/*".
+func validateRefPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "refs/") {
+		return fmt.Errorf("ref pattern must start with refs/: %q", pattern)
+	}
+	if i := strings.IndexByte(pattern, '*'); i != -1 && (i != len(pattern)-1 || !strings.HasSuffix(pattern, "/*")) {
+		return fmt.Errorf("ref pattern may only end with /*: %q", pattern)
+	}
+	return nil
+}
+
+func matchRefPattern(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
+
+// filtersRefs reports whether rc limits the refs to mirror.
+func (rc repositoryConfig) filtersRefs() bool {
+	return len(rc.IncludeRefs) > 0 || len(rc.ExcludeRefs) > 0
+}
+
+// includesRef reports whether the ref name is mirrored and served by rc.
+func (rc repositoryConfig) includesRef(name string) bool {
+	if len(rc.IncludeRefs) > 0 {
+		included := false
+		for _, p := range rc.IncludeRefs {
+			if matchRefPattern(p, name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, p := range rc.ExcludeRefs {
+		if matchRefPattern(p, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetchRefspecs returns the refspecs to fetch into the mirror,
+// excluding refs with negative refspecs.
+func (rc repositoryConfig) fetchRefspecs() []string {
+	includes := rc.IncludeRefs
+	if len(includes) == 0 {
+		includes = []string{"refs/*"}
+	}
+
+	var refspecs []string
+	for _, p := range includes {
+		refspecs = append(refspecs, "+"+p+":"+p)
+	}
+	for _, p := range rc.ExcludeRefs {
+		refspecs = append(refspecs, "^"+p)
+	}
+	return refspecs
+}
+
+// hideRefsConfig returns the options for git upload-pack
+// to hide the refs not included by rc.
+func (rc repositoryConfig) hideRefsConfig() []string {
+	var args []string
+	if len(rc.IncludeRefs) > 0 {
+		args = append(args, "-c", "uploadpack.hideRefs=refs")
+		for _, p := range rc.IncludeRefs {
+			args = append(args, "-c", "uploadpack.hideRefs=!"+strings.TrimSuffix(p, "/*"))
+		}
+	}
+	for _, p := range rc.ExcludeRefs {
+		args = append(args, "-c", "uploadpack.hideRefs="+strings.TrimSuffix(p, "/*"))
+	}
+	return args
+}
+
+// setFetchRefspecs configures the refspecs of the mirror in dir by rc.
+func (repo *repository) setFetchRefspecs(dir string, rc repositoryConfig) error {
+	// fails if not set yet
+	gitConfig := repo.gitCommand("--git-dir=.", "config", "--unset-all", "remote.origin.fetch")
+	gitConfig.cmd.Dir = dir
+	gitConfig.run()
+
+	for _, refspec := range rc.fetchRefspecs() {
+		gitConfig := repo.gitCommand("--git-dir=.", "config", "--add", "remote.origin.fetch", refspec)
+		gitConfig.cmd.Dir = dir
+		if err := gitConfig.run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExcludedRefs deletes the refs not included by rc from the mirror in dir,
+// like those of an imported bundle.
+func (repo *repository) removeExcludedRefs(dir string, rc repositoryConfig) error {
+	var out bytes.Buffer
+	gitForEachRef := repo.gitCommand("--git-dir=.", "for-each-ref", "--format=%(refname)")
+	gitForEachRef.cmd.Dir = dir
+	gitForEachRef.cmd.Stdout = &out
+	if err := gitForEachRef.run(); err != nil {
+		return err
+	}
+
+	var in bytes.Buffer
+	for _, name := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if name != "" && !rc.includesRef(name) {
+			fmt.Fprintf(&in, "delete %s\n", name)
+		}
+	}
+	if in.Len() == 0 {
+		return nil
+	}
+
+	gitUpdateRef := repo.gitCommand("--git-dir=.", "update-ref", "--stdin")
+	gitUpdateRef.cmd.Dir = dir
+	gitUpdateRef.cmd.Stdin = &in
+	return gitUpdateRef.run()
+}
+
+// cloneFiltered clones repo into the empty directory dir with only the refs
+// included by rc, as "git clone --mirror" would fetch all the refs.
+// The objects in the repository at reference, if any, are borrowed.
+func (repo *repository) cloneFiltered(dir string, rc repositoryConfig, reference string) error {
+	for _, args := range [][]string{
+		{"init", "--bare", "."},
+		{"--git-dir=.", "config", "remote.origin.url", repo.upstreamURL},
+		{"--git-dir=.", "config", "remote.origin.mirror", "true"},
+	} {
+		gitCommand := repo.gitCommand(args...)
+		gitCommand.cmd.Dir = dir
+		if err := gitCommand.run(); err != nil {
+			return err
+		}
+	}
+
+	if reference != "" {
+		if err := writeAlternates(dir, reference); err != nil {
+			return err
+		}
+	}
+
+	if err := repo.setFetchRefspecs(dir, rc); err != nil {
+		return err
+	}
+
+	gitFetch := repo.upstreamCommand("--git-dir=.", "fetch", "--verbose", "origin")
+	gitFetch.cmd.Dir = dir
+	if err := gitFetch.run(); err != nil {
+		return err
+	}
+
+	// point HEAD to the same branch as upstream, which "git clone" would do
+	head, err := repo.remoteHead(dir, "origin")
+	if err != nil {
+		return err
+	}
+	if head != "" && rc.includesRef(head) {
+		gitSymbolicRef := repo.gitCommand("--git-dir=.", "symbolic-ref", "HEAD", head)
+		gitSymbolicRef.cmd.Dir = dir
+		if err := gitSymbolicRef.run(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewritesRefs reports whether rc rewrites the refs advertised to clients.
+func (rc repositoryConfig) rewritesRefs() bool {
+	return len(rc.RewriteRefs) > 0
+}
+
+// rewriteRef returns the ref name advertised for name, rewritten by the
+// longest matching prefix in rc.RewriteRefs. It reports false if no prefix
+// matches, in which case the ref is not advertised.
+func (rc repositoryConfig) rewriteRef(name string) (string, bool) {
+	var from string
+	for prefix := range rc.RewriteRefs {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(from) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return "", false
+	}
+	return rc.RewriteRefs[from] + strings.TrimPrefix(name, from), true
+}
+
+// zeroID is the object name advertised when there are no refs.
+const zeroID = "0000000000000000000000000000000000000000"
+
+// rewriteAdvertisement copies the protocol v0 ref advertisement of
+// git upload-pack from r to w, rewriting the ref names by rc.
+// The refs which are not rewritten are omitted, as well as HEAD unless
+// the branch it points to is rewritten.
+// https://github.com/git/git/blob/v2.39.0/Documentation/technical/pack-protocol.txt
+func rewriteAdvertisement(w io.Writer, r io.Reader, rc repositoryConfig) error {
+	type ref struct{ oid, name string }
+
+	var (
+		refs []ref
+		caps []string
+	)
+
+	pkt := newPktLineScanner(r)
+	for i := 0; pkt.Scan(); i++ {
+		line := strings.TrimSuffix(pkt.Text(), "\n")
+		if line == "" {
+			break
+		}
+
+		if i == 0 {
+			if j := strings.IndexByte(line, 0); j != -1 {
+				caps = strings.Fields(line[j+1:])
+				line = line[:j]
+			}
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || parts[1] == "capabilities^{}" {
+			continue
+		}
+		refs = append(refs, ref{oid: parts[0], name: parts[1]})
+	}
+	if err := pkt.Err(); err != nil {
+		return err
+	}
+
+	var head string
+	var rewrittenCaps []string
+	for _, c := range caps {
+		if strings.HasPrefix(c, "symref=HEAD:") {
+			name, ok := rc.rewriteRef(strings.TrimPrefix(c, "symref=HEAD:"))
+			if !ok {
+				continue
+			}
+			head = name
+			c = "symref=HEAD:" + name
+		}
+		rewrittenCaps = append(rewrittenCaps, c)
+	}
+
+	var rewritten []ref
+	for _, r := range refs {
+		if r.name == "HEAD" {
+			if head != "" {
+				rewritten = append(rewritten, r)
+			}
+			continue
+		}
+
+		peeled := strings.HasSuffix(r.name, "^{}")
+		name, ok := rc.rewriteRef(strings.TrimSuffix(r.name, "^{}"))
+		if !ok {
+			continue
+		}
+		if peeled {
+			name += "^{}"
+		}
+		rewritten = append(rewritten, ref{oid: r.oid, name: name})
+	}
+
+	// keep HEAD first, and peeled tags right after the tags, as git does
+	sort.SliceStable(rewritten, func(i, j int) bool {
+		a, b := rewritten[i].name, rewritten[j].name
+		if a == "HEAD" || b == "HEAD" {
+			return a == "HEAD" && b != "HEAD"
+		}
+		if ta, tb := strings.TrimSuffix(a, "^{}"), strings.TrimSuffix(b, "^{}"); ta != tb {
+			return ta < tb
+		}
+		return !strings.HasSuffix(a, "^{}") && strings.HasSuffix(b, "^{}")
+	})
+
+	if len(rewritten) == 0 {
+		rewritten = []ref{{oid: zeroID, name: "capabilities^{}"}}
+	}
+
+	var buf bytes.Buffer
+	for i, r := range rewritten {
+		line := r.oid + " " + r.name
+		if i == 0 {
+			line += "\x00" + strings.Join(rewrittenCaps, " ")
+		}
+		line += "\n"
+		fmt.Fprintf(&buf, "%04x%s", len(line)+4, line)
+	}
+	buf.WriteString("0000")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepositoryConfig_IncludesRef(t *testing.T) {
+	rc := repositoryConfig{
+		IncludeRefs: []string{"refs/heads/*", "refs/tags/*", "refs/meta/config"},
+		ExcludeRefs: []string{"refs/heads/wip/*"},
+	}
+
+	for name, expected := range map[string]bool{
+		"refs/heads/master":   true,
+		"refs/heads/wip/foo":  false,
+		"refs/tags/v1.0":      true,
+		"refs/meta/config":    true,
+		"refs/meta/configs":   false,
+		"refs/pull/1/head":    false,
+		"refs/headsx/foo":     false,
+		"refs/heads/wipx/foo": true,
+	} {
+		if got := rc.includesRef(name); got != expected {
+			t.Errorf("includesRef(%q) = %v", name, got)
+		}
+	}
+
+	if got := (repositoryConfig{}).includesRef("refs/pull/1/head"); !got {
+		t.Error("ref not included without patterns")
+	}
+}
+
+func TestRepositoryConfig_Refspecs(t *testing.T) {
+	rc := repositoryConfig{
+		IncludeRefs: []string{"refs/heads/*"},
+		ExcludeRefs: []string{"refs/heads/wip/*"},
+	}
+
+	if got, expected := rc.fetchRefspecs(), []string{"+refs/heads/*:refs/heads/*", "^refs/heads/wip/*"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("fetchRefspecs() = %v", got)
+	}
+	if got, expected := rc.hideRefsConfig(), []string{
+		"-c", "uploadpack.hideRefs=refs",
+		"-c", "uploadpack.hideRefs=!refs/heads",
+		"-c", "uploadpack.hideRefs=refs/heads/wip",
+	}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("hideRefsConfig() = %v", got)
+	}
+
+	rc = repositoryConfig{ExcludeRefs: []string{"refs/pull/*"}}
+	if got, expected := rc.fetchRefspecs(), []string{"+refs/*:refs/*", "^refs/pull/*"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("fetchRefspecs() = %v", got)
+	}
+}
+
+func TestValidateRefPattern(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"refs/heads/*":     true,
+		"refs/heads/main":  true,
+		"heads/*":          false,
+		"refs/heads/wip*":  false,
+		"refs/*/head":      false,
+		"refs/pull/*/head": false,
+	} {
+		if err := validateRefPattern(pattern); (err == nil) != valid {
+			t.Errorf("validateRefPattern(%q) = %v", pattern, err)
+		}
+	}
+}
+
+func pktLines(lines ...string) string {
+	var s string
+	for _, line := range lines {
+		if line == "" {
+			s += "0000"
+			continue
+		}
+		s += fmt.Sprintf("%04x%s", len(line)+4, line)
+	}
+	return s
+}
+
+func TestRewriteAdvertisement(t *testing.T) {
+	const (
+		oid1 = "1111111111111111111111111111111111111111"
+		oid2 = "2222222222222222222222222222222222222222"
+		oid3 = "3333333333333333333333333333333333333333"
+	)
+
+	rc := repositoryConfig{
+		RewriteRefs: map[string]string{
+			"refs/heads/":      "refs/heads/upstream/",
+			"refs/heads/team/": "refs/heads/",
+			"refs/tags/":       "refs/tags/",
+		},
+	}
+
+	in := pktLines(
+		oid1+" HEAD\x00multi_ack symref=HEAD:refs/heads/master agent=git/2.39.0\n",
+		oid1+" refs/heads/master\n",
+		oid2+" refs/heads/team/feature\n",
+		oid1+" refs/pull/1/head\n",
+		oid2+" refs/tags/v1\n",
+		oid3+" refs/tags/v1^{}\n",
+		"",
+	)
+
+	var out bytes.Buffer
+	if err := rewriteAdvertisement(&out, strings.NewReader(in), rc); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := pktLines(
+		oid1+" HEAD\x00multi_ack symref=HEAD:refs/heads/upstream/master agent=git/2.39.0\n",
+		oid2+" refs/heads/feature\n",
+		oid1+" refs/heads/upstream/master\n",
+		oid2+" refs/tags/v1\n",
+		oid3+" refs/tags/v1^{}\n",
+		"",
+	)
+	if out.String() != expected {
+		t.Errorf("got %q", out.String())
+	}
+
+	// no refs are rewritten
+	rc = repositoryConfig{RewriteRefs: map[string]string{"refs/heads/none/": "refs/heads/"}}
+	out.Reset()
+	if err := rewriteAdvertisement(&out, strings.NewReader(in), rc); err != nil {
+		t.Fatal(err)
+	}
+	expected = pktLines(
+		zeroID+" capabilities^{}\x00multi_ack agent=git/2.39.0\n",
+		"",
+	)
+	if out.String() != expected {
+		t.Errorf("got %q", out.String())
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	syncNoop        = expvar.NewInt("syncNoop")
+	syncRefsChanged = expvar.NewInt("syncRefsChanged")
+)
+
+// parseRefs parses lines of "<object name>\t<ref name>", as printed by
+// "git ls-remote", into a map. Refs other than refs/* such as HEAD and
+// peeled tags are ignored.
+func parseRefs(out []byte) map[string]string {
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := parts[1]
+		if !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "^{}") {
+			continue
+		}
+		refs[name] = parts[0]
+	}
+	return refs
+}
+
+// remoteRefs lists the refs of repo in upstream.
+func (repo *repository) remoteRefs() (map[string]string, error) {
+	var out bytes.Buffer
+	gitLsRemote := repo.upstreamCommand("ls-remote", repo.remote())
+	gitLsRemote.cmd.Stdout = &out
+	if err := gitLsRemote.run(); err != nil {
+		return nil, err
+	}
+	return parseRefs(out.Bytes()), nil
+}
+
+// localRefs lists the refs of the mirror of repo,
+// with the namespace of repo stripped if any.
+func (repo *repository) localRefs() (map[string]string, error) {
+	var out bytes.Buffer
+	gitForEachRef := repo.gitCommand("for-each-ref", "--format=%(objectname)%09%(refname)", repo.refName("refs/"))
+	gitForEachRef.cmd.Stdout = &out
+	if err := gitForEachRef.run(); err != nil {
+		return nil, err
+	}
+
+	refs := parseRefs(out.Bytes())
+	if repo.namespace == "" {
+		return refs, nil
+	}
+
+	stripped := map[string]string{}
+	for name, oid := range refs {
+		stripped[strings.TrimPrefix(name, repo.refName(""))] = oid
+	}
+	return stripped, nil
+}
+
+// refStateOf returns the hash of refs.
+func refStateOf(refs map[string]string) string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", refs[name], name)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// currentRefState returns the hash of the refs of the mirror of repo,
+// computing it if the refs have changed since, or an empty string on errors.
+// Caller must hold the read lock of repo.
+func (repo *repository) currentRefState() string {
+	if state, _ := repo.refState.Load().(string); state != "" {
+		return state
+	}
+
+	refs, err := repo.localRefs()
+	if err != nil {
+		logger.Printf("[repo %s] Could not list refs: %s", repo.path, err)
+		return ""
+	}
+
+	state := refStateOf(refs)
+	repo.refState.Store(state)
+	return state
+}
+
+// diffRefs returns the refs in remote which are new or changed from local,
+// and the refs in local which are removed from remote.
+func diffRefs(local, remote map[string]string) (changed, removed []string) {
+	for name, oid := range remote {
+		if local[name] != oid {
+			changed = append(changed, name)
+		}
+	}
+	for name := range local {
+		if _, ok := remote[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return
+}
+
+// updateMirror updates the mirror of repo from upstream. The refs are listed
+// first with "git ls-remote", so that only the changed refs are fetched
+// and no fetch is done if nothing changed. It reports whether any refs changed.
+// Caller must hold the write lock of repo.
+func (s *server) updateMirror(repo *repository) (bool, error) {
+	remote, err := repo.remoteRefs()
+	if err != nil {
+		return false, err
+	}
+	// refs no longer included are removed from the mirror
+	if rc := s.config.repository(repo.path); rc.filtersRefs() {
+		for name := range remote {
+			if !rc.includesRef(name) {
+				delete(remote, name)
+			}
+		}
+	}
+	local, err := repo.localRefs()
+	if err != nil {
+		return false, err
+	}
+
+	changed, removed := diffRefs(local, remote)
+	if len(changed) == 0 && len(removed) == 0 {
+		syncNoop.Add(1)
+		logger.Printf("[repo %s] Refs not changed upstream", repo.path)
+		return false, nil
+	}
+
+	// refs may change even if updating fails halfway
+	defer s.refsChanged(repo)
+
+	syncRefsChanged.Add(int64(len(changed) + len(removed)))
+	logger.Printf("[repo %s] %d refs changed, %d refs removed upstream", repo.path, len(changed), len(removed))
+
+	if len(changed) > 0 {
+		var refspecs bytes.Buffer
+		for _, name := range changed {
+			fmt.Fprintf(&refspecs, "+%s:%s\n", name, repo.refName(name))
+		}
+		gitFetch := repo.upstreamCommand("fetch", "--verbose", "--no-tags", "--stdin", repo.remote())
+		gitFetch.cmd.Stdin = &refspecs
+		if err := gitFetch.run(); err != nil {
+			return false, err
+		}
+	}
+
+	if len(removed) > 0 {
+		var commands bytes.Buffer
+		for _, name := range removed {
+			fmt.Fprintf(&commands, "delete %s\n", repo.refName(name))
+		}
+		gitUpdateRef := repo.gitCommand("update-ref", "--stdin")
+		gitUpdateRef.cmd.Stdin = &commands
+		if err := gitUpdateRef.run(); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseRefs(t *testing.T) {
+	refs := parseRefs([]byte("" +
+		"1111111111111111111111111111111111111111\tHEAD\n" +
+		"1111111111111111111111111111111111111111\trefs/heads/master\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v1.0\n" +
+		"3333333333333333333333333333333333333333\trefs/tags/v1.0^{}\n"))
+
+	expected := map[string]string{
+		"refs/heads/master": "1111111111111111111111111111111111111111",
+		"refs/tags/v1.0":    "2222222222222222222222222222222222222222",
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("got %v", refs)
+	}
+}
+
+func TestDiffRefs(t *testing.T) {
+	local := map[string]string{
+		"refs/heads/master": "1111111111111111111111111111111111111111",
+		"refs/heads/old":    "2222222222222222222222222222222222222222",
+		"refs/tags/v1.0":    "3333333333333333333333333333333333333333",
+	}
+	remote := map[string]string{
+		"refs/heads/master": "4444444444444444444444444444444444444444",
+		"refs/heads/new":    "2222222222222222222222222222222222222222",
+		"refs/tags/v1.0":    "3333333333333333333333333333333333333333",
+	}
+
+	changed, removed := diffRefs(local, remote)
+	sort.Strings(changed)
+	if expected := []string{"refs/heads/master", "refs/heads/new"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("changed: got %v", changed)
+	}
+	if expected := []string{"refs/heads/old"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("removed: got %v", removed)
+	}
+
+	changed, removed = diffRefs(local, local)
+	if len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("got %v, %v for the same refs", changed, removed)
+	}
+}
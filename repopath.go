@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validateRepositoryPath checks that repoPath, requested by a client, names
+// a repository under base path: it must be relative, without empty, "." nor
+// ".." segments, and must not point into the directories mir uses itself.
+func validateRepositoryPath(repoPath string) error {
+	segments := strings.Split(repoPath, "/")
+	for _, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." || strings.ContainsRune(seg, filepath.Separator) || strings.ContainsRune(seg, 0) {
+			return fmt.Errorf("invalid repository path: %q", repoPath)
+		}
+		if strings.Contains(seg, tempDirInfix) {
+			return fmt.Errorf("invalid repository path: %q", repoPath)
+		}
+	}
+
+	if segments[0] == quarantineDirName || segments[0] == storesDirName {
+		return fmt.Errorf("invalid repository path: %q", repoPath)
+	}
+
+	return nil
+}
+
+// isUnder reports whether path is strictly under dir, after cleaning both.
+func isUnder(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestValidateRepositoryPath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		ok   bool
+	}{
+		{"foo/bar", true},
+		{"foo/.github", true},
+		{"foo/bar.baz", true},
+		{"", false},
+		{"/foo/bar", false},
+		{"foo//bar", false},
+		{"foo/bar/", false},
+		{"../victim", false},
+		{"foo/../../victim", false},
+		{"foo/./bar", false},
+		{".", false},
+		{".quarantine/1/foo/bar", false},
+		{".stores/ns", false},
+		{"foo/bar" + tempDirInfix + "1", false},
+		{"foo/b\x00ar", false},
+	} {
+		if err := validateRepositoryPath(test.path); (err == nil) != test.ok {
+			t.Errorf("validateRepositoryPath(%q) = %v", test.path, err)
+		}
+	}
+}
+
+func TestIsUnder(t *testing.T) {
+	for _, test := range []struct {
+		dir, path string
+		under     bool
+	}{
+		{"/base", "/base/foo/bar", true},
+		{"/base/", "/base/foo", true},
+		{"base", "base/foo", true},
+		{"/base", "/base", false},
+		{"/base", "/base/..", false},
+		{"/base", "/base/../victim", false},
+		{"/base", "/basement/foo", false},
+		{"/base", "/victim", false},
+	} {
+		if got := isUnder(test.dir, test.path); got != test.under {
+			t.Errorf("isUnder(%q, %q) = %v", test.dir, test.path, got)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var sshRequests = expvar.NewInt("sshRequests")
+
+// sshRequestTimeout is the time an SSH client has to authenticate and send
+// its command.
+const sshRequestTimeout = 30 * time.Second
+
+// sshAuthorizedKeysCheckInterval is how often authorized_keys is checked for changes.
+const sshAuthorizedKeysCheckInterval = time.Second
+
+// authorizedKeys is the set of public keys allowed to connect over SSH,
+// loaded from a file in the format of OpenSSH authorized_keys and reloaded
+// when it changes. Key options are ignored.
+type authorizedKeys struct {
+	file string
+
+	mu           sync.Mutex
+	fingerprints map[string]bool
+	modTime      time.Time
+	checkedAt    time.Time
+}
+
+func newAuthorizedKeys(file string) (*authorizedKeys, error) {
+	k := &authorizedKeys{file: file}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *authorizedKeys) reload() error {
+	fi, err := os.Stat(k.file)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(k.file)
+	if err != nil {
+		return err
+	}
+
+	fingerprints := map[string]bool{}
+	for n := 1; len(b) > 0; n++ {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", k.file, n, err)
+		}
+		fingerprints[ssh.FingerprintSHA256(key)] = true
+	}
+
+	k.fingerprints = fingerprints
+	k.modTime = fi.ModTime()
+	return nil
+}
+
+// authorized reports whether key is in the file, reloading it if changed.
+// On failure to reload the previous keys are kept.
+func (k *authorizedKeys) authorized(key ssh.PublicKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if time.Since(k.checkedAt) >= sshAuthorizedKeysCheckInterval {
+		k.checkedAt = time.Now()
+		if fi, err := os.Stat(k.file); err != nil || !fi.ModTime().Equal(k.modTime) {
+			if err := k.reload(); err != nil {
+				logger.Printf("could not reload SSH authorized keys: %s", err)
+			} else {
+				logger.Printf("reloaded SSH authorized keys")
+			}
+		}
+	}
+
+	return k.fingerprints[ssh.FingerprintSHA256(key)]
+}
+
+// newSSHServerConfig returns the configuration for the SSH server with the
+// private host key in hostKeyFile, accepting the public keys in keys.
+// The fingerprint of the key a client authenticated with is its identity.
+func newSSHServerConfig(hostKeyFile string, keys *authorizedKeys) (*ssh.ServerConfig, error) {
+	b, err := ioutil.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", hostKeyFile, err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if !keys.authorized(key) {
+				return nil, fmt.Errorf("unknown public key %s", fingerprint)
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{"fingerprint": fingerprint},
+			}, nil
+		},
+		ServerVersion: "SSH-2.0-mir_" + version,
+	}
+	config.AddHostKey(hostKey)
+
+	return config, nil
+}
+
+// serveSSH serves git-upload-pack over SSH on l, like
+// "git clone git@example.com:org/repo.git", from the same mirrors as HTTP.
+func (s *server) serveSSH(l net.Listener, config *ssh.ServerConfig) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Println(err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.goBackground(func() { s.handleSSHConn(conn, config) }) {
+			conn.Close()
+		}
+	}
+}
+
+func (s *server) handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	// cleared once the client sends its command
+	conn.SetDeadline(time.Now().Add(sshRequestTimeout))
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		logger.Printf("[ssh %s] %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	fingerprint := sconn.Permissions.Extensions["fingerprint"]
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, chReqs, err := newChannel.Accept()
+		if err != nil {
+			logger.Printf("[ssh %s] %s", conn.RemoteAddr(), err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSSHSession(conn, ch, chReqs, fingerprint)
+		}()
+	}
+	wg.Wait()
+}
+
+// handleSSHSession serves the command of a session channel ch, taking
+// the Git protocol from the GIT_PROTOCOL environment variable if sent.
+func (s *server) handleSSHSession(conn net.Conn, ch ssh.Channel, reqs <-chan *ssh.Request, fingerprint string) {
+	defer ch.Close()
+
+	var protocol string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &env); err != nil || env.Name != "GIT_PROTOCOL" {
+				req.Reply(false, nil)
+				continue
+			}
+			protocol = env.Value
+			req.Reply(true, nil)
+
+		case "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			conn.SetDeadline(time.Time{})
+
+			var status uint32
+			if err := s.serveSSHCommand(ch, exec.Command, protocol, conn.RemoteAddr().String(), fingerprint); err != nil {
+				logger.Printf("[ssh %s] %s", conn.RemoteAddr(), err)
+				status = 1
+			}
+
+			ch.CloseWrite()
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// serveSSHCommand serves command, like "git-upload-pack 'org/repo.git'",
+// sent by the client at remoteAddr authenticated with the key of fingerprint.
+func (s *server) serveSSHCommand(ch ssh.Channel, command, protocol, remoteAddr, fingerprint string) error {
+	sshRequests.Add(1)
+	logger.Printf("[ssh %s] %s (%s) %s", remoteAddr, command, fingerprint, protocol)
+
+	_, path, err := parseSSHCommand(command)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "mir: %s\n", err)
+		return err
+	}
+
+	return s.serveNativeUploadPack(ch, path, protocol, remoteAddr, fingerprint)
+}
+
+// parseSSHCommand parses the command sent by an SSH client, like "git-upload-pack 'org/repo.git'".
+func parseSSHCommand(command string) (service, path string, err error) {
+	parts := strings.SplitN(command, " ", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid command: %q", command)
+	}
+
+	service, path = parts[0], parts[1]
+	if service != "git-upload-pack" {
+		return "", "", fmt.Errorf("service not enabled: %s", service)
+	}
+
+	path, err = unquoteShell(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	return service, "/" + strings.TrimPrefix(path, "/"), nil
+}
+
+// unquoteShell unquotes s quoted by git in the manner of sq_quote_buf,
+// that is, in single quotes with a quote itself escaped by a backslash outside quotes.
+func unquoteShell(s string) (string, error) {
+	var b strings.Builder
+	for len(s) > 0 {
+		switch {
+		case s[0] == '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated quote: %q", s)
+			}
+			b.WriteString(s[1 : end+1])
+			s = s[end+2:]
+		case s[0] == '\\' && len(s) > 1:
+			b.WriteByte(s[1])
+			s = s[2:]
+		case s[0] == ' ' || s[0] == '\t':
+			return "", fmt.Errorf("unexpected argument: %q", s)
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return b.String(), nil
+}
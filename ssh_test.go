@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseSSHCommand(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		path    string
+	}{
+		{"git-upload-pack 'motemen/mir.git'", "/motemen/mir.git"},
+		{"git-upload-pack '/motemen/mir.git'", "/motemen/mir.git"},
+		{`git-upload-pack 'it'\''s/mir.git'`, "/it's/mir.git"},
+	} {
+		service, path, err := parseSSHCommand(test.command)
+		if err != nil {
+			t.Errorf("parseSSHCommand(%q): %s", test.command, err)
+			continue
+		}
+		if service != "git-upload-pack" || path != test.path {
+			t.Errorf("parseSSHCommand(%q): got (%q, %q)", test.command, service, path)
+		}
+	}
+
+	for _, command := range []string{
+		"git-receive-pack 'motemen/mir.git'",
+		"git-upload-pack 'motemen/mir.git",
+		"git-upload-pack 'motemen/mir.git' extra",
+		"sh",
+	} {
+		if _, _, err := parseSSHCommand(command); err == nil {
+			t.Errorf("parseSSHCommand(%q): expected error", command)
+		}
+	}
+}
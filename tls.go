@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadCheckInterval is how often the files are checked for changes.
+const tlsReloadCheckInterval = time.Second
+
+// tlsReloader provides the TLS configuration from the certificate, key and
+// optional client CA bundle files, reloading them when they change so that
+// certificates can be renewed without restarting nor dropping connections.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+func newTLSReloader(certFile, keyFile, clientCAFile string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) reload() error {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.clientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *tlsReloader) changed() bool {
+	for i, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// configForClient returns the current configuration, reloading the files
+// if changed. On failure to reload the previous configuration is kept.
+func (r *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= tlsReloadCheckInterval {
+		r.checkedAt = time.Now()
+		if r.changed() {
+			if err := r.reload(); err != nil {
+				logger.Printf("could not reload TLS certificates: %s", err)
+			} else {
+				logger.Printf("reloaded TLS certificates")
+			}
+		}
+	}
+
+	return r.config, nil
+}
+
+// tlsConfig returns the configuration for the server.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.configForClient,
+	}
+}
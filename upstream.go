@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamFailures    = expvar.NewInt("upstreamFailures")
+	upstreamCircuitOpen = expvar.NewInt("upstreamCircuitOpen")
+	staleServed         = expvar.NewInt("staleServed")
+
+	upstreamRateLimited     = expvar.NewInt("upstreamRateLimited")
+	upstreamBudgetExhausted = expvar.NewInt("upstreamBudgetExhausted")
+)
+
+// rateLimitMessages are the phrases in git stderr telling that
+// the upstream host rate limited the request.
+var rateLimitMessages = [][]byte{
+	[]byte("rate limit"),
+	[]byte("too many requests"),
+	[]byte("error: 429"),
+	[]byte("returned error: 429"),
+	[]byte("abuse detection"),
+}
+
+// isRateLimitError reports whether err is a git command failure
+// caused by rate limiting of the upstream host.
+func isRateLimitError(err error) bool {
+	e, ok := err.(*commandError)
+	if !ok {
+		return false
+	}
+
+	stderr := bytes.ToLower(e.stderr)
+	for _, m := range rateLimitMessages {
+		if bytes.Contains(stderr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// notFoundMessages are the phrases in git stderr telling that the repository
+// is not found in upstream, which is not a failure of the upstream host.
+var notFoundMessages = [][]byte{
+	[]byte("not found"),
+	[]byte("does not exist"),
+	[]byte("not exported"),
+	[]byte("does not appear to be a git repository"),
+	[]byte("could not read username"),
+}
+
+// isUpstreamFailure reports whether err, returned by synchronization, is
+// a failure of the upstream host: a command accessing upstream failed,
+// except for a repository not found in upstream. Local errors are not.
+func isUpstreamFailure(err error) bool {
+	e, ok := err.(*commandError)
+	if !ok || !e.upstream {
+		return false
+	}
+	if isRateLimitError(err) {
+		return true
+	}
+
+	stderr := bytes.ToLower(e.stderr)
+	for _, m := range notFoundMessages {
+		if bytes.Contains(stderr, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamBackoffBase is the backoff after the failure that opens the circuit,
+// doubled on each consecutive failure.
+const upstreamBackoffBase = time.Second
+
+// maxUpstreamPressure is the maximum pressure of an upstream host.
+const maxUpstreamPressure = 16
+
+// upstreamHosts tracks the failures of synchronization per upstream host,
+// counting only those of the host itself by isUpstreamFailure.
+// After failureThreshold consecutive failures the circuit for the host opens,
+// and synchronizations are not attempted until exponential backoff passes.
+// A rate limited failure opens the circuit at once.
+//
+// Synchronizations from a host are also limited to the budget of limit,
+// and while the host is rate limiting, the freshness of refs is extended
+// up to maxRefsFreshFor so that fewer synchronizations are attempted.
+type upstreamHosts struct {
+	sync.Mutex
+	m map[string]*upstreamHost
+
+	failureThreshold int
+	maxBackoff       time.Duration
+	limit            rateLimit
+	maxRefsFreshFor  time.Duration
+}
+
+type upstreamHost struct {
+	failures int
+	retryAt  time.Time
+	budget   *tokenBucket
+	// pressure doubles the freshness of refs for each level,
+	// raised on rate limited failures and lowered on successes
+	pressure uint
+}
+
+// upstreamUnavailableError is returned when synchronization is not attempted
+// because the circuit for the upstream host is open.
+type upstreamUnavailableError struct {
+	host    string
+	retryAt time.Time
+}
+
+func (e *upstreamUnavailableError) Error() string {
+	return fmt.Sprintf("upstream %s is unavailable, retrying after %s", e.host, e.retryAt.Format(time.RFC3339))
+}
+
+func upstreamHostOf(upstreamURL string) string {
+	u, err := url.Parse(upstreamURL)
+	if err != nil || u.Host == "" {
+		return upstreamURL
+	}
+	return u.Host
+}
+
+func (u *upstreamHosts) host(name string) *upstreamHost {
+	if u.m == nil {
+		u.m = map[string]*upstreamHost{}
+	}
+	h, ok := u.m[name]
+	if !ok {
+		h = &upstreamHost{}
+		if u.limit.rate > 0 {
+			h.budget = newTokenBucket(u.limit.rate, u.limit.burst)
+		}
+		u.m[name] = h
+	}
+	return h
+}
+
+// allow returns an error if synchronizing from host should not be attempted now.
+func (u *upstreamHosts) allow(name string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	h := u.host(name)
+	if time.Now().Before(h.retryAt) {
+		upstreamCircuitOpen.Add(1)
+		return &upstreamUnavailableError{host: name, retryAt: h.retryAt}
+	}
+	return nil
+}
+
+// spend takes a synchronization from the budget of host. If the budget is
+// exhausted, it waits for the budget to be refilled when wait is true,
+// and returns an error otherwise.
+func (u *upstreamHosts) spend(name string, wait bool) error {
+	for {
+		u.Lock()
+		h := u.host(name)
+		if h.budget == nil {
+			u.Unlock()
+			return nil
+		}
+		ok, d := h.budget.take(time.Now())
+		u.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		upstreamBudgetExhausted.Add(1)
+		if !wait {
+			return &upstreamUnavailableError{host: name, retryAt: time.Now().Add(d)}
+		}
+
+		logger.Printf("[upstream %s] Budget exhausted, waiting for %s", name, d)
+		time.Sleep(d)
+	}
+}
+
+// refsFreshFor returns freshFor extended by the pressure of host.
+// A zero freshFor, which forces synchronization, is never extended.
+func (u *upstreamHosts) refsFreshFor(name string, freshFor time.Duration) time.Duration {
+	u.Lock()
+	defer u.Unlock()
+
+	h := u.host(name)
+	if freshFor <= 0 || h.pressure == 0 {
+		return freshFor
+	}
+
+	extended := freshFor << h.pressure
+	if extended > u.maxRefsFreshFor || extended < freshFor {
+		extended = u.maxRefsFreshFor
+	}
+	if extended < freshFor {
+		return freshFor
+	}
+	return extended
+}
+
+// pressures returns the pressure of each host, for expvar.
+func (u *upstreamHosts) pressures() interface{} {
+	u.Lock()
+	defer u.Unlock()
+
+	m := map[string]uint{}
+	for name, h := range u.m {
+		m[name] = h.pressure
+	}
+	return m
+}
+
+// record records the result of a synchronization from host.
+func (u *upstreamHosts) record(name string, err error) {
+	if err != nil && !isUpstreamFailure(err) {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	h := u.host(name)
+	if err == nil {
+		h.failures = 0
+		h.retryAt = time.Time{}
+		if h.pressure > 0 {
+			h.pressure--
+		}
+		return
+	}
+
+	upstreamFailures.Add(1)
+	h.failures++
+
+	threshold := u.failureThreshold
+	if isRateLimitError(err) {
+		upstreamRateLimited.Add(1)
+		if u.maxRefsFreshFor > 0 && h.pressure < maxUpstreamPressure {
+			h.pressure++
+		}
+		logger.Printf("[upstream %s] Rate limited, raising pressure to %d", name, h.pressure)
+		threshold = 1
+	}
+
+	if threshold > 0 && h.failures >= threshold {
+		backoff := time.Duration(float64(upstreamBackoffBase) * math.Pow(2, float64(h.failures-threshold)))
+		if backoff > u.maxBackoff || backoff <= 0 {
+			backoff = u.maxBackoff
+		}
+		h.retryAt = time.Now().Add(backoff)
+		logger.Printf("[upstream %s] %d consecutive failures, backing off for %s", name, h.failures, backoff)
+	}
+}
+
+// synchronizeForServing synchronizes repo for req, which may be nil,
+// reporting whether the mirror is served stale because synchronization failed.
+// It returns an error only when there is no valid mirror to serve.
+func (s *server) synchronizeForServing(repo *repository, req *http.Request) (stale bool, err error) {
+	err = s.synchronizeCacheWithin(repo, s.freshnessFor(repo.path, req))
+	if err == nil {
+		return false, nil
+	}
+
+	if s.servableStale(repo) {
+		staleServed.Add(1)
+		logger.Printf("[repo %s] warning: serving possibly stale mirror: %s", repo.path, err)
+		return true, nil
+	}
+
+	logger.Println(err)
+	return false, err
+}
+
+// servableStale reports whether the mirror of repo can be served without
+// synchronization, that is, a valid git repository exists under s.basePath.
+func (s *server) servableStale(repo *repository) bool {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	return repo.exists() && isUnder(s.basePath, repo.localDir) && repo.verify() == nil
+}
+
+// synchronizeOrStale synchronizes repo and reports whether it can be served.
+// When synchronization fails but a valid mirror exists, the mirror is served as is,
+// with headers telling the client that it may be stale.
+// Requests from peers filling their mirrors are served without synchronization.
+func (s *server) synchronizeOrStale(repo *repository, w http.ResponseWriter, req *http.Request) bool {
+	if s.isFillRequest(req) {
+		return true
+	}
+
+	stale, err := s.synchronizeForServing(repo, req)
+	if err == nil {
+		if stale {
+			w.Header().Set("X-Mir-Stale", "1")
+			w.Header().Set("Warning", `110 mir "Response is Stale"`)
+		}
+		return true
+	}
+
+	if e, ok := err.(*upstreamUnavailableError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(e.retryAt).Seconds()))))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestIsRateLimitError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("error: RPC failed; HTTP 429 curl 22 The requested URL returned error: 429\n")}, true},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("remote: API Rate Limit exceeded for 192.0.2.1.\n")}, true},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: repository 'https://example.com/foo' not found\n")}, false},
+		{errors.New("rate limit"), false},
+	} {
+		if got := isRateLimitError(test.err); got != test.want {
+			t.Errorf("isRateLimitError(%v) = %v", test.err, got)
+		}
+	}
+}
+
+func TestCommandError_Stderr(t *testing.T) {
+	cmd := repoCommand{cmd: exec.Command("sh", "-c", "echo 'remote: rate limit exceeded' >&2; exit 1"), logger: logger}
+	err := cmd.run()
+	if !isRateLimitError(err) {
+		t.Fatalf("got %#v", err)
+	}
+}
+
+func TestUpstreamHosts_RateLimited(t *testing.T) {
+	u := &upstreamHosts{failureThreshold: 3, maxBackoff: time.Minute, maxRefsFreshFor: 30 * time.Second}
+	rateLimitErr := &commandError{err: errors.New("exit status 128"), stderr: []byte("Too Many Requests"), upstream: true}
+
+	if d := u.refsFreshFor("example.com", 5*time.Second); d != 5*time.Second {
+		t.Errorf("got %s without pressure", d)
+	}
+
+	u.record("example.com", rateLimitErr)
+	if err := u.allow("example.com"); err == nil {
+		t.Error("circuit not opened on rate limited failure")
+	}
+	if d := u.refsFreshFor("example.com", 5*time.Second); d != 10*time.Second {
+		t.Errorf("got %s after rate limited", d)
+	}
+	if d := u.refsFreshFor("example.com", 0); d != 0 {
+		t.Errorf("forced synchronization extended to %s", d)
+	}
+
+	u.record("example.com", rateLimitErr)
+	u.record("example.com", rateLimitErr)
+	if d := u.refsFreshFor("example.com", 5*time.Second); d != 30*time.Second {
+		t.Errorf("got %s beyond maximum", d)
+	}
+
+	if d := u.refsFreshFor("example.org", 5*time.Second); d != 5*time.Second {
+		t.Errorf("got %s for another host", d)
+	}
+
+	// pressure is lowered on each success
+	u.record("example.com", nil)
+	if d := u.refsFreshFor("example.com", 5*time.Second); d != 20*time.Second {
+		t.Errorf("got %s after success", d)
+	}
+}
+
+func TestIsUpstreamFailure(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: unable to connect to example.com:\nexample.com[0: 192.0.2.1]: errno=Connection refused\n"), upstream: true}, true},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("error: RPC failed; HTTP 502 curl 22 The requested URL returned error: 502\n"), upstream: true}, true},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("remote: Too Many Requests\n"), upstream: true}, true},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("remote: Repository not found.\nfatal: repository 'https://example.com/foo/' not found\n"), upstream: true}, false},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: remote error: access denied or repository not exported: /foo.git\n"), upstream: true}, false},
+		{&commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: unable to connect to example.com\n")}, false},
+		{errors.New("mkdir /base/foo: permission denied"), false},
+	} {
+		if got := isUpstreamFailure(test.err); got != test.want {
+			t.Errorf("isUpstreamFailure(%v) = %v", test.err, got)
+		}
+	}
+}
+
+func TestUpstreamHosts_NotFound(t *testing.T) {
+	u := &upstreamHosts{failureThreshold: 1, maxBackoff: time.Minute}
+	notFoundErr := &commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: repository 'https://example.com/foo/' not found\n"), upstream: true}
+
+	for i := 0; i < 3; i++ {
+		u.record("example.com", notFoundErr)
+	}
+	if err := u.allow("example.com"); err != nil {
+		t.Errorf("circuit opened on repositories not found: %s", err)
+	}
+
+	u.record("example.com", &commandError{err: errors.New("exit status 128"), stderr: []byte("fatal: the remote end hung up unexpectedly\n"), upstream: true})
+	if err := u.allow("example.com"); err == nil {
+		t.Error("circuit not opened on failure")
+	}
+}
+
+func TestUpstreamHosts_Spend(t *testing.T) {
+	u := &upstreamHosts{limit: rateLimit{rate: 20, burst: 2}}
+
+	for i := 0; i < 2; i++ {
+		if err := u.spend("example.com", false); err != nil {
+			t.Fatalf("spend #%d in burst: %s", i, err)
+		}
+	}
+
+	if _, ok := u.spend("example.com", false).(*upstreamUnavailableError); !ok {
+		t.Fatal("spend after burst succeeded")
+	}
+
+	start := time.Now()
+	if err := u.spend("example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("spend did not wait: %s", elapsed)
+	}
+
+	unlimited := &upstreamHosts{}
+	for i := 0; i < 100; i++ {
+		if err := unlimited.spend("example.com", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}